@@ -0,0 +1,129 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+)
+
+const transactionUUIDFile = "transaction_uuid"
+
+// Reason of the cancelled event when another client was queued at the same time
+const CancelReasonQueuedSimultaneously = "queued_simultaneously"
+
+// Transaction UUID of the job in progress, the last one handed out or used on the socket
+var currentTransactionUUID atomic.Pointer[string]
+
+func transactionUUIDPath() string {
+	return filepath.Join(daemonSettings.Load().StateDir, transactionUUIDFile)
+}
+
+// Restores the transaction UUID saved by a previous run, so a cancel right
+// after a restart still reaches the right job stats
+func loadTransactionUUID() {
+	data, err := os.ReadFile(transactionUUIDPath())
+	if err != nil {
+		return
+	}
+	if u := strings.TrimSpace(string(data)); u != "" {
+		currentTransactionUUID.Store(&u)
+	}
+}
+
+func setTransactionUUID(u string) {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return
+	}
+	if prev := currentTransactionUUID.Swap(&u); prev != nil && *prev == u {
+		return
+	}
+	if err := writeFileAtomic(transactionUUIDPath(), []byte(u+"\n"), 0644); err != nil {
+		logging.Component("job").Error("failed to save transaction UUID", logging.TransactionUUID(u), "error", err)
+	}
+}
+
+// Reports whether cur is the first poll that carries the cancel job
+func isNewCancel(prev *requests.ClientJobQueueDataResponse, cur *requests.ClientJobQueueDataResponse) bool {
+	return cur.Name == "cancel" && (prev == nil || prev.Name != "cancel")
+}
+
+// A client without a job that is still queued behind another one was queued
+// at the same time as another client, its job will never start
+func queueConflict(jq *requests.ClientJobQueueDataResponse) bool {
+	return jq != nil && jq.Name == "" && jq.QueuePosition != nil && *jq.QueuePosition > 1
+}
+
+// Reports whether cur is the first poll with a queue conflict
+func isNewQueueConflict(prev *requests.ClientJobQueueDataResponse, cur *requests.ClientJobQueueDataResponse) bool {
+	return queueConflict(cur) && !queueConflict(prev)
+}
+
+// Marks the job stats of the current transaction as cancelled. The job stats
+// go through the outbox, so they are not lost if the server is unreachable or
+// the client reboots. Local processes learn about it from the cancelled event.
+func handleJobCancelled() {
+	log := logging.Component("job")
+	log.Info("job cancelled by server")
+	postCancelledJobStats(log)
+}
+
+// Fails the job the same way as a cancel. uit-toolbox-client gets the
+// cancelled event with CancelReasonQueuedSimultaneously and clears the queue
+// entry.
+func handleQueueConflict() {
+	log := logging.Component("job")
+	log.Warn("job failed: queued simultaneously with another client")
+	postCancelledJobStats(log)
+}
+
+func postCancelledJobStats(log *slog.Logger) {
+	u := currentTransactionUUID.Load()
+	if u == nil {
+		log.Warn("job cancelled: no transaction UUID known, job stats not updated")
+		return
+	}
+	log = log.With(logging.TransactionUUID(*u))
+	serial := systemSerial.Load()
+	tag := tagnumber.Load()
+	if serial == nil || tag == 0 {
+		log.Warn("job cancelled: no serial or tag number, job stats not updated")
+		return
+	}
+	o := outbox.Load()
+	if o == nil {
+		return
+	}
+
+	for _, stat := range []struct{ key, value string }{
+		{"erase_completed", "false"},
+		{"clone_completed", "false"},
+		{"job_cancelled", "true"},
+	} {
+		transactionUUID := *u
+		line, err := json.Marshal(HTTPRequestPayload{
+			RequestType:     "POST",
+			Tagnumber:       tag,
+			SystemSerial:    *serial,
+			Key:             stat.key,
+			StringValue:     stat.value,
+			TransactionUUID: &transactionUUID,
+		})
+		if err != nil {
+			log.Error("job cancelled: cannot marshal job stat", logging.Key(stat.key), "error", err)
+			continue
+		}
+		if err := o.add(stat.key, string(line)); err != nil {
+			log.Error("job cancelled: cannot queue job stat", logging.Key(stat.key), "error", err)
+		}
+	}
+	o.notify()
+}
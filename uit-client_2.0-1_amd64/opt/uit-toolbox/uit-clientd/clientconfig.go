@@ -0,0 +1,284 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+	"uit-clientd/retry"
+)
+
+const clientConfigCacheFile = "client-config.json"
+
+// Retries while the client config is stale or missing
+var clientConfigRetryPolicy = retry.Policy{
+	Name:            "client_config",
+	InitialInterval: 5 * time.Second,
+	MaxInterval:     2 * time.Minute,
+}
+
+var (
+	// True while clientConfig came from the on-disk cache instead of the server
+	clientConfigStale atomic.Bool
+)
+
+type clientConfigCache struct {
+	SavedAt time.Time     `json:"saved_at"`
+	Config  *ClientConfig `json:"config"`
+}
+
+// The client config is always fetched from the bootstrap server URL
+func GetClientConfig(ctx context.Context) (*ClientConfig, error) {
+	bootstrapURL := daemonSettings.Load().ServerURL
+	reqURL := &url.URL{
+		Scheme:   bootstrapURL.Scheme,
+		Host:     bootstrapURL.Host,
+		Path:     "/static/client/configs/uit-client",
+		RawQuery: "json=true",
+	}
+	queries := url.Values{}
+	queries.Set("json", "true")
+	reqURL.RawQuery = queries.Encode()
+
+	httpRequestConfig := new(HTTPRequestConfig)
+	httpRequestConfig.URL = *reqURL
+	httpRequestConfig.Method = "GET"
+
+	httpRequest := &HTTPRequest{
+		Config:  httpRequestConfig,
+		Payload: nil,
+	}
+
+	jsonBody, err := sendHTTPRequest(ctx, httpRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error in GetClientConfig: %w", err)
+	}
+	if len(jsonBody) == 0 {
+		return nil, fmt.Errorf("received nil or empty response body in GetClientConfig")
+	}
+
+	var configData ClientConfig
+	if err := json.NewDecoder(bytes.NewReader(jsonBody)).Decode(&configData); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal GetClientConfig response: %w", err)
+	}
+
+	return &configData, nil
+}
+
+func validateClientConfig(cfg *ClientConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("client config is nil")
+	}
+	if strings.TrimSpace(cfg.UIT_WEB_HTTPS_HOST) == "" || strings.TrimSpace(cfg.UIT_WEB_HTTPS_PORT) == "" {
+		return fmt.Errorf("client config has invalid host or port for HTTPS")
+	}
+	if _, err := net.LookupPort("tcp", strings.TrimSpace(cfg.UIT_WEB_HTTPS_PORT)); err != nil {
+		return fmt.Errorf("client config has invalid HTTPS port '%s': %w", cfg.UIT_WEB_HTTPS_PORT, err)
+	}
+	return nil
+}
+
+func clientConfigCachePath() string {
+	return filepath.Join(daemonSettings.Load().StateDir, clientConfigCacheFile)
+}
+
+// Saves a validated client config as the last known good copy.
+// The config has database credentials in it, so the file is root-only.
+func saveClientConfigCache(cfg *ClientConfig) error {
+	data, err := json.Marshal(clientConfigCache{SavedAt: time.Now(), Config: cfg})
+	if err != nil {
+		return fmt.Errorf("cannot marshal client config cache: %w", err)
+	}
+	return writeFileAtomic(clientConfigCachePath(), data, 0600)
+}
+
+func loadClientConfigCache() (*ClientConfig, time.Time, error) {
+	path := clientConfigCachePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot read client config cache '%s': %w", path, err)
+	}
+	var cache clientConfigCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot parse client config cache '%s': %w", path, err)
+	}
+	if err := validateClientConfig(cache.Config); err != nil {
+		return nil, time.Time{}, fmt.Errorf("cached client config is invalid: %w", err)
+	}
+	return cache.Config, cache.SavedAt, nil
+}
+
+// Loads the first client config. If the server cannot be reached, the last
+// known good copy is used and marked stale.
+func initClientConfig(ctx context.Context) {
+	log := logging.Component("client_config")
+	cfg, err := GetClientConfig(ctx)
+	if err == nil {
+		err = validateClientConfig(cfg)
+	}
+	if err == nil {
+		clientConfig.Store(cfg)
+		clientConfigStale.Store(false)
+		applyServerEndpoint()
+		if err := saveClientConfigCache(cfg); err != nil {
+			log.Error("failed to save client config cache", "error", err)
+		}
+		return
+	}
+	log.Error("failed to get client config from server", "error", err)
+	lifecycle.recordError(PhaseWaitingConfig, err)
+
+	cached, savedAt, cacheErr := loadClientConfigCache()
+	if cacheErr != nil {
+		log.Warn("no usable client config cache, continuing without client config", "error", cacheErr)
+		return
+	}
+	clientConfig.Store(cached)
+	clientConfigStale.Store(true)
+	applyServerEndpoint()
+	log.Warn("using STALE client config, retrying server in the background", "saved_at", savedAt.Format(time.RFC3339))
+}
+
+// Points every HTTP request at the HTTPS host from the client config,
+// or at the bootstrap server URL until a valid client config is loaded.
+func applyServerEndpoint() {
+	endpoint := daemonSettings.Load().ServerURL
+	if cfg := clientConfig.Load(); cfg != nil {
+		host := strings.TrimSpace(cfg.UIT_WEB_HTTPS_HOST)
+		port := strings.TrimSpace(cfg.UIT_WEB_HTTPS_PORT)
+		if host != "" && port != "" {
+			endpoint.Host = net.JoinHostPort(host, port)
+		}
+	}
+	if current, err := requests.ServerURL(); err == nil && current == endpoint {
+		return
+	}
+	requests.SetServerURL(endpoint)
+	// Idle connections still point at the old host, in-flight requests finish as normal
+	sharedHTTPClient.CloseIdleConnections()
+}
+
+func isSecretConfigField(name string) bool {
+	upper := strings.ToUpper(name)
+	return strings.Contains(upper, "PASSWD") || strings.Contains(upper, "PASSWORD") ||
+		strings.Contains(upper, "SECRET") || strings.Contains(upper, "TOKEN")
+}
+
+// Returns one "FIELD: old -> new" line per changed field, secrets are redacted
+func diffClientConfig(oldCfg *ClientConfig, newCfg *ClientConfig) []string {
+	if oldCfg == nil {
+		oldCfg = &ClientConfig{}
+	}
+	oldVal := reflect.ValueOf(*oldCfg)
+	newVal := reflect.ValueOf(*newCfg)
+	cfgType := oldVal.Type()
+
+	var changes []string
+	for i := range cfgType.NumField() {
+		name := cfgType.Field(i).Name
+		before := fmt.Sprint(oldVal.Field(i).Interface())
+		after := fmt.Sprint(newVal.Field(i).Interface())
+		if before == after {
+			continue
+		}
+		if isSecretConfigField(name) {
+			changes = append(changes, fmt.Sprintf("%s: (redacted) -> (redacted)", name))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: '%s' -> '%s'", name, before, after))
+	}
+	return changes
+}
+
+// Fetches and validates a new client config, then swaps it in.
+// On any error the current config stays in place.
+func reloadClientConfig(ctx context.Context, reason string) error {
+	cfg, err := GetClientConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if err := validateClientConfig(cfg); err != nil {
+		return err
+	}
+
+	oldCfg := clientConfig.Swap(cfg)
+	wasStale := clientConfigStale.Swap(false)
+	applyServerEndpoint()
+	log := logging.Component("client_config")
+	if err := saveClientConfigCache(cfg); err != nil {
+		log.Error("failed to save client config cache", "error", err)
+	}
+	if wasStale || oldCfg == nil {
+		log.Info("fresh client config received from server")
+	}
+
+	changes := diffClientConfig(oldCfg, cfg)
+	if len(changes) == 0 {
+		log.Info("client config reloaded, no changes", "reason", reason)
+		return nil
+	}
+	log.Info("client config reloaded", "reason", reason, "changes", changes)
+	return nil
+}
+
+// Reloads the client config on every SIGHUP and every refresh interval until ctx is done.
+// While the config is stale or missing, failed reloads back off up to the refresh interval.
+func clientConfigReloadLoop(ctx context.Context, hup <-chan os.Signal, refreshInterval time.Duration) {
+	retryPolicy := clientConfigRetryPolicy
+	retryPolicy.InitialInterval = min(retryPolicy.InitialInterval, refreshInterval)
+	retryPolicy.MaxInterval = min(retryPolicy.MaxInterval, refreshInterval)
+	backoff := retryPolicy.NewBackoff()
+
+	usable := func() bool {
+		return clientConfig.Load() != nil && !clientConfigStale.Load()
+	}
+	firstInterval := refreshInterval
+	if !usable() {
+		firstInterval = retryPolicy.InitialInterval
+	}
+	timer := time.NewTimer(firstInterval)
+	defer timer.Stop()
+
+	for {
+		var reason string
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reason = "SIGHUP"
+		case <-timer.C:
+			reason = "periodic refresh"
+			if !usable() {
+				reason = "retry after startup failure"
+			}
+		}
+		err := reloadClientConfig(ctx, reason)
+		if err == nil {
+			lifecycle.count(func(c *LifecycleCounters) { c.ConfigReloads++ })
+			backoff.Success()
+			timer.Reset(refreshInterval)
+			continue
+		}
+		lifecycle.count(func(c *LifecycleCounters) { c.ConfigReloadFailures++ })
+		lifecycle.recordError(PhaseWaitingConfig, err)
+		if usable() {
+			logging.Component("client_config").Warn("failed to reload client config, keeping current config", "reason", reason, "error", err)
+			timer.Reset(refreshInterval)
+			continue
+		}
+		timer.Reset(backoff.Delay(err))
+	}
+}
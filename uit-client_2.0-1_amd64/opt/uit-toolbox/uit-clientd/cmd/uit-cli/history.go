@@ -0,0 +1,119 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"uit-clientd/journal"
+)
+
+// uit-cli history [--key <key>] [--uuid <uuid>] [--since <time>] [--until <time>] [--window <duration>] [--limit <n>] [--json]
+// Prints the newest request outcomes recorded by uit-clientd, oldest first.
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	key := fs.String("key", "", "Only requests for this key")
+	transactionUUID := fs.String("uuid", "", "Only requests with this transaction UUID")
+	since := fs.String("since", "", "Only requests at or after this RFC3339 time")
+	until := fs.String("until", "", "Only requests at or before this RFC3339 time")
+	window := fs.Duration("window", 0, "Only requests from the last duration (e.g. 1h)")
+	limit := fs.Int("limit", 50, "At most this many of the newest requests")
+	asJSON := fs.Bool("json", false, "Print the entries as JSON instead of a table")
+	socketPath := fs.String("socket", "", "Path of the uit-clientd unix socket (default from uit-clientd settings)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	q := url.Values{}
+	if s := strings.TrimSpace(*key); s != "" {
+		q.Set("key", s)
+	}
+	if s := strings.TrimSpace(*transactionUUID); s != "" {
+		q.Set("transaction_uuid", s)
+	}
+	if s := strings.TrimSpace(*since); s != "" {
+		q.Set("since", s)
+	}
+	if s := strings.TrimSpace(*until); s != "" {
+		q.Set("until", s)
+	}
+	if *window > 0 {
+		q.Set("window", window.String())
+	}
+	if *limit > 0 {
+		q.Set("limit", strconv.Itoa(*limit))
+	}
+
+	unixSocketPath, err := resolveSocketPath(*socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		return 1
+	}
+	conn, err := getUnixSocketConnection(unixSocketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to connect to %s: %v\n", unixSocketPath, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if err := sendDataToSocket(conn, HTTPRequestPayload{RequestType: "GET", Key: "history", StringValue: q.Encode()}); err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to write to socket: %v\n", err)
+		return 1
+	}
+	response, err := readResponseFromSocket(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to read response from socket: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		var out bytes.Buffer
+		if err := json.Indent(&out, []byte(response), "", "  "); err != nil {
+			out.Reset()
+			out.WriteString(response)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", out.String())
+		return 0
+	}
+
+	var entries []journal.Entry
+	if err := json.Unmarshal([]byte(response), &entries); err != nil {
+		fmt.Fprintf(os.Stderr, "cli: invalid history response: %v\n", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSOURCE\tKEY\tMETHOD\tOUTCOME\tSTATUS\tLATENCY\tUUID\tDETAIL")
+	for _, e := range entries {
+		status := "-"
+		if e.HTTPStatus != 0 {
+			status = strconv.Itoa(e.HTTPStatus)
+		}
+		uuid := e.TransactionUUID
+		if uuid == "" {
+			uuid = "-"
+		}
+		detail := e.Error
+		if e.Validation != "ok" {
+			detail = e.Validation
+		}
+		if detail == "" && e.Value != "" {
+			detail = "value=" + e.Value
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%.1fms\t%s\t%s\n",
+			e.Time.Local().Format(time.DateTime), e.Source, e.Key, e.Method, e.Outcome, status, e.LatencyMS, uuid, detail)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		return 1
+	}
+	return 0
+}
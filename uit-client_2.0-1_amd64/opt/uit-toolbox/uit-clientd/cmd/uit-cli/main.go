@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"uit-clientd/config"
 	"uit-clientd/keypolicy"
 )
 
@@ -26,9 +27,7 @@ type HTTPRequestPayload struct {
 	TransactionUUID *string `json:"transaction_uuid"`
 }
 
-const unixSocketPath = "/run/uit-client/uit-clientd.sock"
-
-func getUnixSocketConnection() (net.Conn, error) {
+func getUnixSocketConnection(unixSocketPath string) (net.Conn, error) {
 	conn, err := net.DialTimeout("unix", unixSocketPath, 5*time.Second)
 	if err != nil {
 		return nil, err
@@ -49,7 +48,7 @@ func sendDataToSocket(conn net.Conn, payload HTTPRequestPayload) error {
 }
 
 func readResponseFromSocket(conn net.Conn) (string, error) {
-	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+	if err := conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
 		return "", fmt.Errorf("failed to set read deadline: %v", err)
 	}
 	response, err := bufio.NewReader(conn).ReadString('\n')
@@ -67,7 +66,33 @@ func readResponseFromSocket(conn net.Conn) (string, error) {
 	return response, nil
 }
 
+// Socket path resolves the same way as in uit-clientd (flag, then file, then env)
+func resolveSocketPath(flagValue string) (string, error) {
+	if path := strings.TrimSpace(flagValue); path != "" {
+		return path, nil
+	}
+	settings, err := config.Load(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to load settings: %w", err)
+	}
+	return settings.SocketPath, nil
+}
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "watch":
+			os.Exit(runWatch(os.Args[2:]))
+		case "usage":
+			os.Exit(runUsage(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		}
+	}
+
 	serial := flag.String("serial", "", "System serial number of client (required)")
 	tagnumber := flag.Int64("tag", 0, "Tag number of client (optional)")
 	key := flag.String("key", "", "Key of request to send")
@@ -76,8 +101,13 @@ func main() {
 	methodGET := flag.Bool("get", false, "Use GET method for the request (default is POST)")
 	methodPOST := flag.Bool("post", false, "Use POST method for the request (default is POST)")
 	methodDELETE := flag.Bool("delete", false, "Use DELETE method for the request (default is POST)")
+	socketPath := flag.String("socket", "", "Path of the uit-clientd unix socket (default from uit-clientd settings)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "cli: Usage: %s --serial <serial> [--tag <tagnumber>] --key <key> [--value <value>] [--uuid <uuid>] [--get | --post | --delete]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s status [--wait-ready] [--timeout <duration>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch [--until <event type>[,...]]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s usage [--metric cpu|network] [--last <n>] [--window <duration>] [--since <time>] [--stats-only]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s history [--key <key>] [--uuid <uuid>] [--since <time>] [--until <time>] [--window <duration>] [--limit <n>] [--json]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -179,8 +209,14 @@ func main() {
 	}
 	httpPayload.RequestType = rule.Method
 
+	unixSocketPath, err := resolveSocketPath(*socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		os.Exit(1)
+	}
+
 	// connect to unix socket
-	conn, err := getUnixSocketConnection()
+	conn, err := getUnixSocketConnection(unixSocketPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cli: failed to connect to %s: %v\n", unixSocketPath, err)
 		os.Exit(1)
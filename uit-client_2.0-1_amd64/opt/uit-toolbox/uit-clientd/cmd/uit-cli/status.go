@@ -0,0 +1,98 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Only the fields uit-cli needs, the daemon sends more
+type daemonStatus struct {
+	Phase string `json:"phase"`
+	Ready bool   `json:"ready"`
+}
+
+func queryDaemonStatus(unixSocketPath string) (string, error) {
+	conn, err := getUnixSocketConnection(unixSocketPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %w", unixSocketPath, err)
+	}
+	defer conn.Close()
+
+	if err := sendDataToSocket(conn, HTTPRequestPayload{RequestType: "GET", Key: "status"}); err != nil {
+		return "", fmt.Errorf("failed to write to socket: %w", err)
+	}
+	response, err := readResponseFromSocket(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from socket: %w", err)
+	}
+	return response, nil
+}
+
+// uit-cli status [--wait-ready] [--timeout <duration>]
+// Prints the daemon status as JSON. With --wait-ready, blocks until the daemon
+// is ready and exits 1 if the timeout passes first.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	waitReady := fs.Bool("wait-ready", false, "Wait until uit-clientd is ready")
+	timeout := fs.Duration("timeout", 0, "Give up waiting after this long, 0 waits forever (with --wait-ready)")
+	quiet := fs.Bool("quiet", false, "Do not print the status")
+	socketPath := fs.String("socket", "", "Path of the uit-clientd unix socket (default from uit-clientd settings)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	unixSocketPath, err := resolveSocketPath(*socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		return 1
+	}
+
+	var deadline time.Time
+	if *timeout > 0 {
+		deadline = time.Now().Add(*timeout)
+	}
+
+	for {
+		response, err := queryDaemonStatus(unixSocketPath)
+		if err != nil && !*waitReady {
+			fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+			return 1
+		}
+
+		var st daemonStatus
+		if err == nil {
+			if jsonErr := json.Unmarshal([]byte(response), &st); jsonErr != nil {
+				fmt.Fprintf(os.Stderr, "cli: invalid status from uit-clientd: %v\n", jsonErr)
+				return 1
+			}
+		}
+
+		if err == nil && (!*waitReady || st.Ready) {
+			if !*quiet {
+				var out bytes.Buffer
+				if err := json.Indent(&out, []byte(response), "", "  "); err != nil {
+					out.Reset()
+					out.WriteString(response)
+				}
+				fmt.Fprintf(os.Stdout, "%s\n", out.String())
+			}
+			return 0
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cli: timed out waiting for uit-clientd: %v\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "cli: timed out waiting for uit-clientd to be ready (phase: %s)\n", st.Phase)
+			}
+			return 1
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// uit-cli usage --metric <cpu|network> [--last <n>] [--window <duration>] [--since <time>] [--stats-only]
+// Prints CPU or network usage history kept by uit-clientd as JSON, with
+// min/max/avg over the selected samples. Without filters, only the latest sample.
+func runUsage(args []string) int {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	metric := fs.String("metric", "cpu", "Metric to query: cpu (percent) or network (kbit/s)")
+	last := fs.Int("last", 0, "At most this many of the newest samples")
+	window := fs.Duration("window", 0, "Only samples from the last duration (e.g. 5m)")
+	since := fs.String("since", "", "Only samples at or after this RFC3339 time")
+	statsOnly := fs.Bool("stats-only", false, "Print only min/max/avg, not the samples")
+	socketPath := fs.String("socket", "", "Path of the uit-clientd unix socket (default from uit-clientd settings)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	q := url.Values{}
+	q.Set("metric", strings.TrimSpace(*metric))
+	if *last > 0 {
+		q.Set("last", strconv.Itoa(*last))
+	}
+	if *window > 0 {
+		q.Set("window", window.String())
+	}
+	if s := strings.TrimSpace(*since); s != "" {
+		q.Set("since", s)
+	}
+	if *statsOnly {
+		q.Set("stats_only", "true")
+	}
+
+	unixSocketPath, err := resolveSocketPath(*socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		return 1
+	}
+	conn, err := getUnixSocketConnection(unixSocketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to connect to %s: %v\n", unixSocketPath, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if err := sendDataToSocket(conn, HTTPRequestPayload{RequestType: "GET", Key: "usage_history", StringValue: q.Encode()}); err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to write to socket: %v\n", err)
+		return 1
+	}
+	response, err := readResponseFromSocket(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to read response from socket: %v\n", err)
+		return 1
+	}
+
+	var resp struct {
+		Incomplete bool `json:"incomplete"`
+	}
+	if json.Unmarshal([]byte(response), &resp) == nil && resp.Incomplete {
+		fmt.Fprintf(os.Stderr, "cli: usage history does not reach back to --since, stats cover only part of it\n")
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(response), "", "  "); err != nil {
+		out.Reset()
+		out.WriteString(response)
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", out.String())
+	return 0
+}
@@ -0,0 +1,79 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// uit-cli watch [--until <type>[,<type>...]]
+// Prints one JSON line per job event from uit-clientd. With --until, exits 0
+// after printing the first event of one of the given types.
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	until := fs.String("until", "", "Exit after the first event of these types (comma separated, e.g. running,finished)")
+	socketPath := fs.String("socket", "", "Path of the uit-clientd unix socket (default from uit-clientd settings)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var untilTypes []string
+	for t := range strings.SplitSeq(*until, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			untilTypes = append(untilTypes, t)
+		}
+	}
+
+	unixSocketPath, err := resolveSocketPath(*socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		return 1
+	}
+	conn, err := getUnixSocketConnection(unixSocketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to connect to %s: %v\n", unixSocketPath, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if err := sendDataToSocket(conn, HTTPRequestPayload{RequestType: "GET", Key: "subscribe"}); err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to write to socket: %v\n", err)
+		return 1
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "ERROR: ") {
+			fmt.Fprintf(os.Stderr, "cli: %s\n", line)
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", line)
+
+		if len(untilTypes) == 0 {
+			continue
+		}
+		var ev struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal([]byte(line), &ev); err == nil && slices.Contains(untilTypes, ev.Type) {
+			return 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "cli: failed to read events: %v\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "cli: uit-clientd closed the event stream\n")
+	}
+	return 1
+}
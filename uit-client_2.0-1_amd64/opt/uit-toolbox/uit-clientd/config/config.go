@@ -0,0 +1,485 @@
+//go:build linux && amd64
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"uit-clientd/logging"
+)
+
+const (
+	DefaultConfigPath = "/etc/uit-client/config.json"
+	configPathEnv     = "UIT_CLIENTD_CONFIG"
+)
+
+// Settings are the local bootstrap settings of uit-clientd. They are resolved
+// before anything is fetched from the server, so they cannot come from ClientConfig.
+type Settings struct {
+	ServerURL              url.URL
+	SocketPath             string
+	JobPollInterval        time.Duration
+	ConfigRefreshInterval  time.Duration
+	StateDir               string
+	JobQueueDataPath       string
+	ShutdownTimeout        time.Duration
+	TelemetryInterval      time.Duration
+	HardwareReportInterval time.Duration
+	UsageSampleInterval    time.Duration
+	UsageHistoryDuration   time.Duration
+	FramebufferDevice      string
+	ScreenshotIntervals    map[string]time.Duration // keyed by job state
+	ScreenshotMaxBytes     int64                    // PNG, uploaded or from a local process
+	ScreenshotJPEGMaxBytes int64
+	ScreenshotStallTimeout time.Duration
+	ConsoleDevice          string // empty disables console capture
+	ConsoleFormat          string // text or ansi
+	JournalMaxBytes        int64
+	MetricsListen          string // unix socket path or loopback host:port, empty disables it
+	MetricsUploadInterval  time.Duration
+	LogFormat              string // see logging.Setup
+	LogLevel               slog.Level
+
+	// Where each setting came from (default, file, env or flag), keyed by file key
+	Sources map[string]string
+}
+
+type setting struct {
+	key   string // key in the JSON file
+	env   string
+	flag  string
+	usage string
+	def   string
+	set   func(s *Settings, v string) error
+}
+
+// Order of precedence, lowest to highest: default, file, env, flag
+var settingsTable = []setting{
+	{
+		key: "server_url", env: "UIT_CLIENTD_SERVER_URL", flag: "server-url",
+		usage: "Base URL of the UIT web server",
+		def:   "https://10.0.0.1:31411",
+		set: func(s *Settings, v string) error {
+			u, err := parseServerURL(v)
+			if err != nil {
+				return err
+			}
+			s.ServerURL = *u
+			return nil
+		},
+	},
+	{
+		key: "socket_path", env: "UIT_CLIENTD_SOCKET_PATH", flag: "socket",
+		usage: "Path of the uit-clientd unix socket",
+		def:   "/run/uit-client/uit-clientd.sock",
+		set:   setPath(func(s *Settings) *string { return &s.SocketPath }),
+	},
+	{
+		key: "job_poll_interval", env: "UIT_CLIENTD_JOB_POLL_INTERVAL", flag: "job-poll-interval",
+		usage: "Interval between job queue polls",
+		def:   "3s",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.JobPollInterval }),
+	},
+	{
+		key: "config_refresh_interval", env: "UIT_CLIENTD_CONFIG_REFRESH_INTERVAL", flag: "config-refresh-interval",
+		usage: "Interval between client config refreshes",
+		def:   "5m",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.ConfigRefreshInterval }),
+	},
+	{
+		key: "state_dir", env: "UIT_CLIENTD_STATE_DIR", flag: "state-dir",
+		usage: "Directory for persistent daemon state",
+		def:   "/var/lib/uit-client",
+		set:   setPath(func(s *Settings) *string { return &s.StateDir }),
+	},
+	{
+		key: "job_queue_data_path", env: "UIT_CLIENTD_JOB_QUEUE_DATA_PATH", flag: "job-queue-data",
+		usage: "Path that job queue data is published to",
+		def:   "/root/job_queue_data",
+		set:   setPath(func(s *Settings) *string { return &s.JobQueueDataPath }),
+	},
+	{
+		key: "shutdown_timeout", env: "UIT_CLIENTD_SHUTDOWN_TIMEOUT", flag: "shutdown-timeout",
+		usage: "How long in-flight requests and the outbox get to finish on shutdown",
+		def:   "10s",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.ShutdownTimeout }),
+	},
+	{
+		key: "telemetry_interval", env: "UIT_CLIENTD_TELEMETRY_INTERVAL", flag: "telemetry-interval",
+		usage: "Interval between live telemetry reports",
+		def:   "5s",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.TelemetryInterval }),
+	},
+	{
+		key: "hardware_report_interval", env: "UIT_CLIENTD_HARDWARE_REPORT_INTERVAL", flag: "hardware-report-interval",
+		usage: "Interval between disk temperature reports",
+		def:   "1m",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.HardwareReportInterval }),
+	},
+	{
+		key: "usage_sample_interval", env: "UIT_CLIENTD_USAGE_SAMPLE_INTERVAL", flag: "usage-sample-interval",
+		usage: "Interval between CPU and network usage history samples",
+		def:   "3s",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.UsageSampleInterval }),
+	},
+	{
+		key: "usage_history_duration", env: "UIT_CLIENTD_USAGE_HISTORY_DURATION", flag: "usage-history-duration",
+		usage: "How far back CPU and network usage history goes, at least as long as the longest job",
+		def:   "24h",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.UsageHistoryDuration }),
+	},
+	{
+		key: "framebuffer_device", env: "UIT_CLIENTD_FRAMEBUFFER_DEVICE", flag: "framebuffer",
+		usage: "Framebuffer device that live screenshots are taken from",
+		def:   "/dev/fb0",
+		set:   setPath(func(s *Settings) *string { return &s.FramebufferDevice }),
+	},
+	{
+		key: "screenshot_intervals", env: "UIT_CLIENTD_SCREENSHOT_INTERVALS", flag: "screenshot-intervals",
+		usage: "Interval between live screenshots per job state, as state=duration pairs",
+		def:   "idle=5s,queued=5s,erasing=3s,cloning=3s,failed=10s",
+		set:   setDurationMap(func(s *Settings) *map[string]time.Duration { return &s.ScreenshotIntervals }),
+	},
+	{
+		key: "screenshot_max_bytes", env: "UIT_CLIENTD_SCREENSHOT_MAX_BYTES", flag: "screenshot-max-bytes",
+		usage: "Largest live screenshot that is uploaded, in bytes with an optional K, M or G suffix",
+		def:   "16M",
+		set:   setByteSize(func(s *Settings) *int64 { return &s.ScreenshotMaxBytes }),
+	},
+	{
+		key: "screenshot_jpeg_max_bytes", env: "UIT_CLIENTD_SCREENSHOT_JPEG_MAX_BYTES", flag: "screenshot-jpeg-max-bytes",
+		usage: "Largest live screenshot that is uploaded when the server asks for JPEG, in bytes with an optional K, M or G suffix",
+		def:   "4M",
+		set:   setByteSize(func(s *Settings) *int64 { return &s.ScreenshotJPEGMaxBytes }),
+	},
+	{
+		key: "screenshot_stall_timeout", env: "UIT_CLIENTD_SCREENSHOT_STALL_TIMEOUT", flag: "screenshot-stall-timeout",
+		usage: "How long a screenshot upload waits for more data from its source before giving up",
+		def:   "5s",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.ScreenshotStallTimeout }),
+	},
+	{
+		key: "console_device", env: "UIT_CLIENTD_CONSOLE_DEVICE", flag: "console",
+		usage: "Virtual console (/dev/vcsaN) whose text is sent to the live view, \"none\" to disable",
+		def:   "/dev/vcsa1",
+		set: func(s *Settings, v string) error {
+			if strings.TrimSpace(v) == "none" {
+				s.ConsoleDevice = ""
+				return nil
+			}
+			return setPath(func(s *Settings) *string { return &s.ConsoleDevice })(s, v)
+		},
+	},
+	{
+		key: "console_format", env: "UIT_CLIENTD_CONSOLE_FORMAT", flag: "console-format",
+		usage: "How console text is sent: text, or ansi to keep colors",
+		def:   "ansi",
+		set: func(s *Settings, v string) error {
+			v = strings.ToLower(strings.TrimSpace(v))
+			if v != "text" && v != "ansi" {
+				return fmt.Errorf("console format must be text or ansi: '%s'", v)
+			}
+			s.ConsoleFormat = v
+			return nil
+		},
+	},
+	{
+		key: "journal_max_bytes", env: "UIT_CLIENTD_JOURNAL_MAX_BYTES", flag: "journal-max-bytes",
+		usage: "Size at which the local request journal is rotated, in bytes with an optional K, M or G suffix",
+		def:   "1M",
+		set:   setByteSize(func(s *Settings) *int64 { return &s.JournalMaxBytes }),
+	},
+	{
+		key: "metrics_listen", env: "UIT_CLIENTD_METRICS_LISTEN", flag: "metrics-listen",
+		usage: "Where Prometheus metrics are served: a unix socket path, a localhost host:port, or \"none\"",
+		def:   "none",
+		set: func(s *Settings, v string) error {
+			address, err := parseMetricsListen(v)
+			if err != nil {
+				return err
+			}
+			s.MetricsListen = address
+			return nil
+		},
+	},
+	{
+		key: "metrics_upload_interval", env: "UIT_CLIENTD_METRICS_UPLOAD_INTERVAL", flag: "metrics-upload-interval",
+		usage: "Interval at which metrics are included in live data reports",
+		def:   "1m",
+		set:   setDuration(func(s *Settings) *time.Duration { return &s.MetricsUploadInterval }),
+	},
+	{
+		key: "log_format", env: "UIT_CLIENTD_LOG_FORMAT", flag: "log-format",
+		usage: "Log output: text, json, journal (priority prefixes for journald) or auto",
+		def:   logging.FormatAuto,
+		set: func(s *Settings, v string) error {
+			format, err := logging.ParseFormat(v)
+			if err != nil {
+				return err
+			}
+			s.LogFormat = format
+			return nil
+		},
+	},
+	{
+		key: "log_level", env: "UIT_CLIENTD_LOG_LEVEL", flag: "log-level",
+		usage: "Lowest level that is logged: debug, info, warn or error",
+		def:   "info",
+		set: func(s *Settings, v string) error {
+			level, err := logging.ParseLevel(v)
+			if err != nil {
+				return err
+			}
+			s.LogLevel = level
+			return nil
+		},
+	},
+}
+
+// Load resolves Settings from the defaults, the config file, the environment
+// and args (usually os.Args[1:]), in that order. A missing config file is not an error.
+func Load(args []string) (*Settings, error) {
+	fs := flag.NewFlagSet("uit-clientd", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Path to config file (default "+DefaultConfigPath+")")
+	flagValues := make(map[string]*string, len(settingsTable))
+	for _, st := range settingsTable {
+		flagValues[st.key] = fs.String(st.flag, "", st.usage+" (default "+st.def+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	s := &Settings{Sources: make(map[string]string, len(settingsTable))}
+	for _, st := range settingsTable {
+		if err := st.set(s, st.def); err != nil {
+			return nil, fmt.Errorf("invalid default for '%s': %w", st.key, err)
+		}
+		s.Sources[st.key] = "default"
+	}
+
+	// Config file
+	path := DefaultConfigPath
+	explicitPath := false
+	if v := strings.TrimSpace(os.Getenv(configPathEnv)); v != "" {
+		path, explicitPath = v, true
+	}
+	if strings.TrimSpace(*configPath) != "" {
+		path, explicitPath = strings.TrimSpace(*configPath), true
+	}
+	fileValues, err := readFile(path)
+	if err != nil {
+		// The default file is optional, an explicitly requested one is not
+		if !errors.Is(err, os.ErrNotExist) || explicitPath {
+			return nil, err
+		}
+	}
+	for _, st := range settingsTable {
+		v, ok := fileValues[st.key]
+		if !ok {
+			continue
+		}
+		if err := st.set(s, v); err != nil {
+			return nil, fmt.Errorf("invalid value for '%s' in '%s': %w", st.key, path, err)
+		}
+		s.Sources[st.key] = "file"
+	}
+
+	// Environment
+	for _, st := range settingsTable {
+		v, ok := os.LookupEnv(st.env)
+		if !ok || strings.TrimSpace(v) == "" {
+			continue
+		}
+		if err := st.set(s, v); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", st.env, err)
+		}
+		s.Sources[st.key] = "env"
+	}
+
+	// Flags, only the ones actually passed
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, st := range settingsTable {
+			if st.flag != f.Name || flagErr != nil {
+				continue
+			}
+			if err := st.set(s, *flagValues[st.key]); err != nil {
+				flagErr = fmt.Errorf("invalid value for --%s: %w", st.flag, err)
+				return
+			}
+			s.Sources[st.key] = "flag"
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	return s, nil
+}
+
+func readFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open config file '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	raw := make(map[string]any)
+	if err := json.NewDecoder(io.LimitReader(f, 1<<20)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("cannot parse config file '%s': %w", path, err)
+	}
+
+	known := make(map[string]bool, len(settingsTable))
+	for _, st := range settingsTable {
+		known[st.key] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if !known[k] {
+			return nil, fmt.Errorf("unknown key '%s' in config file '%s'", k, path)
+		}
+		switch val := v.(type) {
+		case string:
+			values[k] = val
+		case float64:
+			values[k] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			values[k] = strconv.FormatBool(val)
+		default:
+			return nil, fmt.Errorf("value of '%s' in config file '%s' must be a string, number or bool", k, path)
+		}
+	}
+	return values, nil
+}
+
+func parseServerURL(v string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(v))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse server URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("server URL must use https: '%s'", v)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("server URL has no host: '%s'", v)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("server URL cannot have a path: '%s'", v)
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, nil
+}
+
+// Metrics are for the machine itself, so TCP is only allowed on loopback
+func parseMetricsListen(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "none" {
+		return "", nil
+	}
+	if strings.HasPrefix(v, "/") {
+		return v, nil
+	}
+	host, port, err := net.SplitHostPort(v)
+	if err != nil {
+		return "", fmt.Errorf("metrics address must be a unix socket path or host:port: '%s'", v)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid metrics port: '%s'", v)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("metrics can only be served on localhost: '%s'", v)
+	}
+	return v, nil
+}
+
+func setPath(field func(s *Settings) *string) func(s *Settings, v string) error {
+	return func(s *Settings, v string) error {
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "/") {
+			return fmt.Errorf("path must be absolute: '%s'", v)
+		}
+		*field(s) = v
+		return nil
+	}
+}
+
+func setDuration(field func(s *Settings) *time.Duration) func(s *Settings, v string) error {
+	return func(s *Settings, v string) error {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("duration must be greater than 0: %s", d)
+		}
+		*field(s) = d
+		return nil
+	}
+}
+
+// Parses a byte count like "512K" or "16M", suffixes are powers of 1024
+func setByteSize(field func(s *Settings) *int64) func(s *Settings, v string) error {
+	return func(s *Settings, v string) error {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		shift := 0
+		switch {
+		case strings.HasSuffix(v, "K"):
+			shift = 10
+		case strings.HasSuffix(v, "M"):
+			shift = 20
+		case strings.HasSuffix(v, "G"):
+			shift = 30
+		}
+		if shift > 0 {
+			v = v[:len(v)-1]
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return err
+		}
+		if n <= 0 || n > (1<<62)>>shift {
+			return fmt.Errorf("size out of range: %s", v)
+		}
+		*field(s) = n << shift
+		return nil
+	}
+}
+
+// Parses "name=duration,name=duration"
+func setDurationMap(field func(s *Settings) *map[string]time.Duration) func(s *Settings, v string) error {
+	return func(s *Settings, v string) error {
+		m := make(map[string]time.Duration)
+		for pair := range strings.SplitSeq(v, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(pair, "=")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" {
+				return fmt.Errorf("expected name=duration: '%s'", pair)
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("invalid duration for '%s': %w", name, err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("duration for '%s' must be greater than 0: %s", name, d)
+			}
+			m[name] = d
+		}
+		*field(s) = m
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+//go:build linux && amd64
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayering(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string // job_poll_interval in the config file, empty for none
+		env    string
+		flag   string
+		want   time.Duration
+		source string
+	}{
+		{"default", "", "", "", 3 * time.Second, "default"},
+		{"file over default", "10s", "", "", 10 * time.Second, "file"},
+		{"env over file", "10s", "20s", "", 20 * time.Second, "env"},
+		{"flag over env", "10s", "20s", "30s", 30 * time.Second, "flag"},
+		{"flag over file", "10s", "", "30s", 30 * time.Second, "flag"},
+		{"blank env is unset", "10s", " ", "", 10 * time.Second, "file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "{}"
+			if tt.file != "" {
+				content = `{"job_poll_interval": "` + tt.file + `"}`
+			}
+			t.Setenv(configPathEnv, writeConfig(t, content))
+			t.Setenv("UIT_CLIENTD_JOB_POLL_INTERVAL", tt.env)
+			var args []string
+			if tt.flag != "" {
+				args = []string{"--job-poll-interval", tt.flag}
+			}
+
+			s, err := Load(args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if s.JobPollInterval != tt.want || s.Sources["job_poll_interval"] != tt.source {
+				t.Errorf("job_poll_interval = %s from %s, want %s from %s",
+					s.JobPollInterval, s.Sources["job_poll_interval"], tt.want, tt.source)
+			}
+			// Settings that were not touched keep their default
+			if s.Sources["socket_path"] != "default" {
+				t.Errorf("socket_path from %s, want default", s.Sources["socket_path"])
+			}
+		})
+	}
+}
+
+func TestLoadConfigPath(t *testing.T) {
+	envPath := writeConfig(t, `{"state_dir": "/from/env/path"}`)
+	flagPath := writeConfig(t, `{"state_dir": "/from/flag/path"}`)
+	t.Setenv(configPathEnv, envPath)
+
+	s, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if s.StateDir != "/from/env/path" {
+		t.Errorf("state_dir = %s, want the one from %s", s.StateDir, configPathEnv)
+	}
+
+	s, err = Load([]string{"--config", flagPath})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if s.StateDir != "/from/flag/path" {
+		t.Errorf("state_dir = %s, want the one from --config", s.StateDir)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string // in the error
+	}{
+		{"explicit file missing", "", nil, []string{"--config", "/nonexistent/config.json"}, "cannot open config file"},
+		{"unknown key", `{"no_such_setting": 1}`, nil, nil, "unknown key 'no_such_setting'"},
+		{"not an object", `[]`, nil, nil, "cannot parse config file"},
+		{"nested value", `{"state_dir": {"a": 1}}`, nil, nil, "must be a string, number or bool"},
+		{"bad file value", `{"job_poll_interval": "soon"}`, nil, nil, "invalid value for 'job_poll_interval'"},
+		{"bad env value", `{}`, map[string]string{"UIT_CLIENTD_JOB_POLL_INTERVAL": "-1s"}, nil, "UIT_CLIENTD_JOB_POLL_INTERVAL"},
+		{"bad flag value", `{}`, nil, []string{"--state-dir", "relative"}, "--state-dir"},
+		{"plain http", `{"server_url": "http://server"}`, nil, nil, "must use https"},
+		{"metrics off loopback", `{"metrics_listen": "0.0.0.0:9100"}`, nil, nil, "only be served on localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.file != "" {
+				t.Setenv(configPathEnv, writeConfig(t, tt.file))
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := Load(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetByteSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"512", 512, true},
+		{"4k", 4 << 10, true},
+		{" 16M ", 16 << 20, true},
+		{"1G", 1 << 30, true},
+		{"0", 0, false},
+		{"-1K", 0, false},
+		{"1T", 0, false},
+		{"M", 0, false},
+	}
+	for _, tt := range tests {
+		var s Settings
+		err := setByteSize(func(s *Settings) *int64 { return &s.ScreenshotMaxBytes })(&s, tt.value)
+		if (err == nil) != tt.ok || s.ScreenshotMaxBytes != tt.want {
+			t.Errorf("setByteSize(%q) = %d, %v, want %d, ok %v", tt.value, s.ScreenshotMaxBytes, err, tt.want, tt.ok)
+		}
+	}
+}
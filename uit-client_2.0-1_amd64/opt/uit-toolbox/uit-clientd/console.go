@@ -0,0 +1,126 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/retry"
+	"uit-clientd/vconsole"
+)
+
+// A 200x80 console with a color change on every cell stays well under this
+const maxLiveConsoleSize = 1 << 20
+
+// Sends the virtual console text, skipping captures identical to the last one
+// sent until the screenshot keep-alive is due
+type consoleUploader struct {
+	device   string
+	format   string // text or ansi
+	lastHash uint64
+	lastSent time.Time
+}
+
+func (u *consoleUploader) take(ctx context.Context) error {
+	screen, err := vconsole.Read(u.device)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	data := LiveConsoleData{
+		Format:     u.format,
+		Lines:      screen.Lines,
+		Columns:    screen.Columns,
+		CursorX:    screen.CursorX,
+		CursorY:    screen.CursorY,
+		CapturedAt: time.Now().UTC(),
+	}
+	if u.format == "ansi" {
+		data.Text = screen.ANSI()
+	} else {
+		data.Text = screen.Text()
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s %d %d %d %d\n%s", data.Format, data.Lines, data.Columns, data.CursorX, data.CursorY, data.Text)
+	sum := h.Sum64()
+	opts, _ := screenshotOptionsFrom(clientConfig.Load()) // errors are logged by the screenshot loop
+	if sum == u.lastHash && time.Since(u.lastSent) < opts.KeepAlive {
+		lifecycle.count(func(c *LifecycleCounters) { c.ConsoleCapturesSkipped++ })
+		return nil
+	}
+
+	value, err := json.Marshal(data)
+	if err != nil {
+		return retry.Permanent(fmt.Errorf("cannot marshal console capture: %w", err))
+	}
+	if err := sendClientKey(ctx, "live_console", string(value)); err != nil {
+		return err
+	}
+	u.lastHash, u.lastSent = sum, time.Now()
+	lifecycle.count(func(c *LifecycleCounters) { c.ConsoleCapturesSent++ })
+	return nil
+}
+
+// Sends the text of a virtual console until ctx is done, on the same schedule
+// as screenshots but far smaller
+func runConsoleLoop(ctx context.Context, device string, format string, intervals map[string]time.Duration) {
+	scheduler := newScreenshotScheduler("console", intervals)
+	uploader := &consoleUploader{device: device, format: format}
+	backoff := retry.Policy{
+		Name:            "console",
+		InitialInterval: scheduler.intervals[screenshotIdle],
+		MaxInterval:     time.Minute,
+	}.NewBackoff()
+	timer := time.NewTimer(scheduler.intervals[screenshotIdle])
+	defer timer.Stop()
+
+	if screen, err := vconsole.Read(device); err != nil {
+		logging.Component("console").Warn("cannot read console", "error", err)
+	} else {
+		logging.Component("console").Info("console found", "device", device, "columns", screen.Columns, "lines", screen.Lines, "format", format)
+	}
+
+	events, unsubscribe := jobEvents.subscribe()
+	defer func() { unsubscribe() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				events, unsubscribe = jobEvents.subscribe()
+				continue
+			}
+			if scheduler.changedBy(event.Job) {
+				timer.Reset(0)
+			}
+			continue
+		case <-timer.C:
+		}
+
+		if systemSerial.Load() == nil {
+			timer.Reset(scheduler.intervals[screenshotIdle])
+			continue // awaiting system identity
+		}
+		delay, capture := scheduler.next(jobQueueData.Load())
+		if !capture {
+			timer.Reset(delay)
+			continue
+		}
+		if err := uploader.take(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			timer.Reset(max(delay, backoff.Delay(err)))
+			continue
+		}
+		backoff.Success()
+		timer.Reset(delay)
+	}
+}
@@ -0,0 +1,182 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+	"uit-clientd/retry"
+
+	"github.com/google/uuid"
+)
+
+type EnrollmentState string
+
+const (
+	EnrollmentResolvingID EnrollmentState = "resolving_identity"
+	EnrollmentLookingUp   EnrollmentState = "looking_up"
+	EnrollmentRegistering EnrollmentState = "registering"
+	EnrollmentAwaitingTag EnrollmentState = "awaiting_tag"
+	EnrollmentEnrolled    EnrollmentState = "enrolled"
+)
+
+// Enrollment never gives up. An unknown serial backs off like a network
+// error while it waits for a tag, other errors wait the max interval.
+var enrollmentRetryPolicy = retry.Policy{
+	Name:            "enrollment",
+	InitialInterval: 2 * time.Second,
+	MaxInterval:     1 * time.Minute,
+	Classify: func(err error) bool {
+		return errors.Is(err, requests.ErrTagNotFound) || retry.IsRetryable(err)
+	},
+}
+
+// EnrollmentStatus is returned as JSON for the enrollment_status socket key
+type EnrollmentStatus struct {
+	State        EnrollmentState `json:"state"`
+	SystemSerial string          `json:"system_serial"`
+	SerialSource string          `json:"system_serial_source"`
+	Tagnumber    *int64          `json:"tagnumber"`
+	Registered   bool            `json:"registered"`
+	Attempts     int64           `json:"attempts"`
+	LastError    string          `json:"last_error,omitempty"`
+	StateSince   time.Time       `json:"state_since"`
+	NextAttempt  *time.Time      `json:"next_attempt,omitempty"`
+}
+
+var enrollmentStatus atomic.Pointer[EnrollmentStatus]
+
+func setEnrollmentStatus(update func(st *EnrollmentStatus)) {
+	next := EnrollmentStatus{}
+	if cur := enrollmentStatus.Load(); cur != nil {
+		next = *cur
+	}
+	prevState := next.State
+	update(&next)
+	if next.State != prevState {
+		next.StateSince = time.Now()
+		logging.Component("enrollment").Info("state changed", "from", prevState, "to", next.State)
+	}
+	enrollmentStatus.Store(&next)
+}
+
+// Registers the serial with the server, without a tag number
+func registerClient(ctx context.Context, id requests.SystemIdentity) error {
+	u, err := uuid.NewV7()
+	if err != nil {
+		return fmt.Errorf("cannot create transaction UUID: %w", err)
+	}
+	transactionUUID := u.String()
+	systemSerialCopy := id.Serial
+
+	httpRequest := &HTTPRequest{
+		Config: &HTTPRequestConfig{
+			URL:    url.URL{Path: "/api/client/init"},
+			Method: "POST",
+		},
+		Payload: &HTTPRequestPayload{
+			RequestType:     "POST",
+			SystemSerial:    id.Serial,
+			Key:             "init",
+			TransactionUUID: &transactionUUID,
+			Value: &ClientInitRequest{
+				Tagnumber:       nil,
+				SystemSerial:    &systemSerialCopy,
+				TransactionUUID: &transactionUUID,
+			},
+		},
+	}
+	if _, err := sendHTTPRequest(ctx, httpRequest); err != nil {
+		return fmt.Errorf("error in registerClient: %w", err)
+	}
+	return nil
+}
+
+// Looks up the tag number for the system serial until one is assigned.
+// An unknown serial is registered through the init endpoint first.
+// Retries back off according to enrollmentRetryPolicy.
+func runEnrollment(ctx context.Context, id requests.SystemIdentity) {
+	setEnrollmentStatus(func(st *EnrollmentStatus) {
+		st.State = EnrollmentLookingUp
+		st.SystemSerial = id.Serial
+		st.SerialSource = string(id.Source)
+	})
+
+	backoff := enrollmentRetryPolicy.NewBackoff()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		tag, err := requests.GetTagFromSerial(ctx, id)
+		if err == nil {
+			backoff.Success()
+			tagnumber.Store(tag)
+			setEnrollmentStatus(func(st *EnrollmentStatus) {
+				st.State = EnrollmentEnrolled
+				st.Tagnumber = &tag
+				st.Attempts++
+				st.LastError = ""
+				st.NextAttempt = nil
+			})
+			logging.Component("enrollment").Info("enrolled", logging.Serial(id.Serial), logging.Tagnumber(tag))
+			return
+		}
+
+		if errors.Is(err, requests.ErrTagNotFound) {
+			cur := enrollmentStatus.Load()
+			if cur == nil || !cur.Registered {
+				setEnrollmentStatus(func(st *EnrollmentStatus) { st.State = EnrollmentRegistering })
+				if regErr := registerClient(ctx, id); regErr != nil {
+					err = regErr
+				} else {
+					setEnrollmentStatus(func(st *EnrollmentStatus) { st.Registered = true })
+					backoff.Reset()
+				}
+			}
+			if cur := enrollmentStatus.Load(); cur != nil && cur.Registered {
+				setEnrollmentStatus(func(st *EnrollmentStatus) { st.State = EnrollmentAwaitingTag })
+			}
+		}
+
+		delay := backoff.Delay(err)
+		next := time.Now().Add(delay)
+		errStr := ""
+		if !errors.Is(err, requests.ErrTagNotFound) {
+			errStr = err.Error()
+			lifecycle.recordError(PhaseWaitingTag, err)
+		}
+		setEnrollmentStatus(func(st *EnrollmentStatus) {
+			st.Attempts++
+			st.LastError = errStr
+			st.NextAttempt = &next
+		})
+
+		timer.Reset(delay)
+	}
+}
+
+func enrollmentStatusJSON() (string, error) {
+	st := enrollmentStatus.Load()
+	if st == nil {
+		st = &EnrollmentStatus{State: EnrollmentResolvingID}
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal enrollment status: %w", err)
+	}
+	return string(b), nil
+}
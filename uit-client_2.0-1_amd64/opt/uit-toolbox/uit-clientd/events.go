@@ -0,0 +1,218 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+)
+
+type JobEventType string
+
+const (
+	JobEventSnapshot        JobEventType = "snapshot" // current state, sent once when subscribing
+	JobEventQueued          JobEventType = "queued"
+	JobEventRunning         JobEventType = "running"
+	JobEventPositionChanged JobEventType = "position_changed"
+	JobEventCancelled       JobEventType = "cancelled"
+	JobEventFinished        JobEventType = "finished"
+)
+
+const (
+	// Events a subscriber may fall behind by before it is disconnected
+	subscriberBuffer       = 32
+	subscriberWriteTimeout = 5 * time.Second
+)
+
+// JobEvent is sent as one JSON line to subscribe connections
+type JobEvent struct {
+	Type     JobEventType                         `json:"type"`
+	Sequence uint64                               `json:"sequence"`
+	Time     time.Time                            `json:"time"`
+	Job      *requests.ClientJobQueueDataResponse `json:"job"`
+	// Why a job was cancelled by the client rather than the server
+	Reason string `json:"reason,omitempty"`
+}
+
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan JobEvent]struct{}
+	last *JobEvent
+}
+
+var jobEvents = &eventBroker{subs: make(map[chan JobEvent]struct{})}
+
+// Returns a channel of events, starting with a snapshot of the current state.
+// The channel is closed if the subscriber falls too far behind.
+func (b *eventBroker) subscribe() (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, subscriberBuffer)
+	b.mu.Lock()
+	if b.last != nil {
+		snapshot := *b.last
+		snapshot.Type = JobEventSnapshot
+		ch <- snapshot
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe
+}
+
+func (b *eventBroker) hasState() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last != nil
+}
+
+func (b *eventBroker) publish(ev JobEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last = &ev
+	if ev.Type == JobEventSnapshot {
+		return // state only, nothing changed
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			logging.Component("job_events").Warn("disconnecting subscriber that fell behind", "buffer", subscriberBuffer)
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func jobActive(jq *requests.ClientJobQueueDataResponse) bool {
+	return jq != nil && jq.Name != ""
+}
+
+func jobRunning(jq *requests.ClientJobQueueDataResponse) bool {
+	return jq != nil && jq.IsRunning != nil && *jq.IsRunning
+}
+
+func jobQueued(jq *requests.ClientJobQueueDataResponse) bool {
+	return jq != nil && jq.IsQueued != nil && *jq.IsQueued
+}
+
+// Works out what happened between two polls of the job queue
+func deriveJobEvents(prev *requests.ClientJobQueueDataResponse, cur *requests.ClientJobQueueDataResponse) []JobEventType {
+	var events []JobEventType
+
+	if isNewCancel(prev, cur) || isNewQueueConflict(prev, cur) {
+		return append(events, JobEventCancelled)
+	}
+
+	switch {
+	case jobActive(prev) && !jobActive(cur):
+		// A job that was running has ended, one that never ran was taken off the queue
+		if jobRunning(prev) {
+			events = append(events, JobEventFinished)
+		} else {
+			events = append(events, JobEventCancelled)
+		}
+		return events
+	case jobActive(prev) && jobActive(cur) && prev.Name != cur.Name:
+		// Replaced by another job
+		if jobRunning(prev) {
+			events = append(events, JobEventFinished)
+		} else {
+			events = append(events, JobEventCancelled)
+		}
+		prev = nil
+	}
+
+	if !jobActive(cur) {
+		return events
+	}
+	if !jobActive(prev) || (!jobQueued(prev) && jobQueued(cur)) {
+		events = append(events, JobEventQueued)
+	}
+	if jobRunning(cur) && !jobRunning(prev) {
+		events = append(events, JobEventRunning)
+	}
+	if jobActive(prev) && !jobRunning(cur) {
+		prevPos, curPos := prev.QueuePosition, cur.QueuePosition
+		if (prevPos == nil) != (curPos == nil) || (prevPos != nil && curPos != nil && *prevPos != *curPos) {
+			events = append(events, JobEventPositionChanged)
+		}
+	}
+	return events
+}
+
+// Called by the poll loop for every newly published job state
+func publishJobEvents(prev *requests.ClientJobQueueDataResponse, cur requests.ClientJobQueueDataResponse, sequence uint64) {
+	now := time.Now()
+	types := deriveJobEvents(prev, &cur)
+	if len(types) == 0 {
+		jobEvents.publish(JobEvent{Type: JobEventSnapshot, Sequence: sequence, Time: now, Job: &cur})
+		return
+	}
+	for _, t := range types {
+		event := JobEvent{Type: t, Sequence: sequence, Time: now, Job: &cur}
+		if t == JobEventCancelled && isNewQueueConflict(prev, &cur) {
+			event.Reason = CancelReasonQueuedSimultaneously
+		}
+		jobEvents.publish(event)
+	}
+}
+
+func isSubscribeRequest(line string) bool {
+	httpRequest, err := MapInputToHTTPRequest(strings.TrimSpace(line))
+	return err == nil && httpRequest.Payload != nil && httpRequest.Payload.Key == "subscribe"
+}
+
+// Takes over a subscribe connection and writes one JSON line per event until
+// ctx is done, the client hangs up or falls too far behind.
+func streamJobEvents(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Anything the client sends from now on is ignored, EOF means it is gone
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	events, unsubscribe := jobEvents.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("job event subscriber fell behind, disconnected")
+			}
+			line, err := json.Marshal(ev)
+			if err != nil {
+				return fmt.Errorf("cannot marshal job event: %w", err)
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(subscriberWriteTimeout))
+			if _, err := conn.Write(append(line, '\n')); err != nil {
+				if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("cannot write job event: %w", err)
+			}
+		}
+	}
+}
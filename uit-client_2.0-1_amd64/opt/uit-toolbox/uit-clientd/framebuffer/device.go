@@ -0,0 +1,155 @@
+//go:build linux && amd64
+
+package framebuffer
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const DefaultDevice = "/dev/fb0"
+
+// ioctls from linux/fb.h
+const (
+	fbioGetVScreenInfo = 0x4600
+	fbioGetFScreenInfo = 0x4602
+)
+
+// struct fb_var_screeninfo
+type varScreenInfo struct {
+	XRes, YRes                 uint32
+	XResVirtual, YResVirtual   uint32
+	XOffset, YOffset           uint32
+	BitsPerPixel               uint32
+	Grayscale                  uint32
+	Red, Green, Blue, Transp   struct{ Offset, Length, MSBRight uint32 }
+	NonStd                     uint32
+	Activate                   uint32
+	Height, Width              uint32
+	AccelFlags                 uint32
+	PixClock                   uint32
+	LeftMargin, RightMargin    uint32
+	UpperMargin, LowerMargin   uint32
+	HSyncLen, VSyncLen         uint32
+	Sync, VMode, Rotate, Color uint32
+	Reserved                   [4]uint32
+}
+
+// struct fb_fix_screeninfo, Go pads it the same way as C on amd64
+type fixScreenInfo struct {
+	ID           [16]byte
+	SmemStart    uint64
+	SmemLen      uint32
+	Type         uint32
+	TypeAux      uint32
+	Visual       uint32
+	XPanStep     uint16
+	YPanStep     uint16
+	YWrapStep    uint16
+	LineLength   uint32
+	MMIOStart    uint64
+	MMIOLen      uint32
+	Accel        uint32
+	Capabilities uint16
+	Reserved     [2]uint16
+}
+
+// Info is the geometry and pixel format of a framebuffer device
+type Info struct {
+	Name    string
+	Width   int
+	Height  int
+	Stride  int // bytes per line
+	Offset  int // byte offset of the visible screen in framebuffer memory
+	Format  PixelFormat
+	MemSize int
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func readInfo(f *os.File) (Info, error) {
+	var v varScreenInfo
+	if err := ioctl(f.Fd(), fbioGetVScreenInfo, unsafe.Pointer(&v)); err != nil {
+		return Info{}, fmt.Errorf("FBIOGET_VSCREENINFO on '%s' failed: %w", f.Name(), err)
+	}
+	var fix fixScreenInfo
+	if err := ioctl(f.Fd(), fbioGetFScreenInfo, unsafe.Pointer(&fix)); err != nil {
+		return Info{}, fmt.Errorf("FBIOGET_FSCREENINFO on '%s' failed: %w", f.Name(), err)
+	}
+
+	info := Info{
+		Name:    string(fix.ID[:clen(fix.ID[:])]),
+		Width:   int(v.XRes),
+		Height:  int(v.YRes),
+		Stride:  int(fix.LineLength),
+		MemSize: int(fix.SmemLen),
+		Format: PixelFormat{
+			BitsPerPixel: v.BitsPerPixel,
+			Red:          Bitfield{Offset: v.Red.Offset, Length: v.Red.Length},
+			Green:        Bitfield{Offset: v.Green.Offset, Length: v.Green.Length},
+			Blue:         Bitfield{Offset: v.Blue.Offset, Length: v.Blue.Length},
+			Transp:       Bitfield{Offset: v.Transp.Offset, Length: v.Transp.Length},
+		},
+	}
+	if info.Stride == 0 {
+		info.Stride = info.Width * int(v.BitsPerPixel) / 8
+	}
+	info.Offset = int(v.YOffset)*info.Stride + int(v.XOffset)*int(v.BitsPerPixel)/8
+	return info, nil
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// ReadInfo returns the geometry and pixel format of a framebuffer device
+func ReadInfo(device string) (Info, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return Info{}, fmt.Errorf("cannot open framebuffer '%s': %w", device, err)
+	}
+	defer f.Close()
+	return readInfo(f)
+}
+
+// Capture reads the visible screen of a framebuffer device into an image
+func Capture(device string) (*image.RGBA, Info, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("cannot open framebuffer '%s': %w", device, err)
+	}
+	defer f.Close()
+
+	info, err := readInfo(f)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	size := info.Stride * info.Height
+	if info.MemSize > 0 && info.Offset+size > info.MemSize {
+		return nil, info, fmt.Errorf("visible screen (%d bytes at %d) is outside framebuffer memory (%d bytes)", size, info.Offset, info.MemSize)
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, int64(info.Offset)); err != nil && err != io.EOF {
+		return nil, info, fmt.Errorf("cannot read framebuffer '%s': %w", device, err)
+	}
+
+	img, err := ToImage(info.Format, info.Width, info.Height, info.Stride, buf)
+	if err != nil {
+		return nil, info, fmt.Errorf("cannot convert framebuffer '%s' (%s): %w", device, info.Format, err)
+	}
+	return img, info, nil
+}
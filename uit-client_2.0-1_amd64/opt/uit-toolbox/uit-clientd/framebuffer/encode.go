@@ -0,0 +1,71 @@
+//go:build linux && amd64
+
+package framebuffer
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// EncodePNG writes img as PNG, tuned for speed over size since screenshots
+// are taken every few seconds
+func EncodePNG(w io.Writer, img image.Image) error {
+	bw := bufio.NewWriter(w)
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(bw, img); err != nil {
+		return fmt.Errorf("cannot encode PNG: %w", err)
+	}
+	return bw.Flush()
+}
+
+// EncodeJPEG writes img as JPEG at quality 1 to 100
+func EncodeJPEG(w io.Writer, img image.Image, quality int) error {
+	if quality < 1 || quality > 100 {
+		return fmt.Errorf("JPEG quality out of range (1-100): %d", quality)
+	}
+	bw := bufio.NewWriter(w)
+	if err := jpeg.Encode(bw, img, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("cannot encode JPEG: %w", err)
+	}
+	return bw.Flush()
+}
+
+// Downscale shrinks img to at most maxWidth pixels wide, keeping the aspect
+// ratio. Each output pixel is the average of the source pixels it covers, so
+// text stays readable. img is returned as is if it is already small enough.
+func Downscale(img *image.RGBA, maxWidth int) *image.RGBA {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	if maxWidth <= 0 || srcW <= maxWidth {
+		return img
+	}
+	dstW := maxWidth
+	dstH := max(1, srcH*dstW/srcW)
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for dy := range dstH {
+		y0, y1 := dy*srcH/dstH, max((dy+1)*srcH/dstH, dy*srcH/dstH+1)
+		for dx := range dstW {
+			x0, x1 := dx*srcW/dstW, max((dx+1)*srcW/dstW, dx*srcW/dstW+1)
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := img.Pix[sy*img.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					px := row[sx*4:]
+					r += uint32(px[0])
+					g += uint32(px[1])
+					bl += uint32(px[2])
+					a += uint32(px[3])
+					n++
+				}
+			}
+			out := dst.Pix[dy*dst.Stride+dx*4:]
+			out[0], out[1], out[2], out[3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,150 @@
+//go:build linux && amd64
+
+package framebuffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// Bitfield is where one color channel sits in a pixel, as in struct fb_bitfield
+type Bitfield struct {
+	Offset uint32
+	Length uint32
+}
+
+// PixelFormat describes the pixels of a framebuffer. Pixels are little-endian
+// words of BitsPerPixel bits, the bitfields index into that word.
+type PixelFormat struct {
+	BitsPerPixel uint32
+	Red          Bitfield
+	Green        Bitfield
+	Blue         Bitfield
+	Transp       Bitfield
+}
+
+// Common framebuffer formats, named after the pixel word from high to low bits
+var (
+	RGB565 = PixelFormat{
+		BitsPerPixel: 16,
+		Red:          Bitfield{Offset: 11, Length: 5},
+		Green:        Bitfield{Offset: 5, Length: 6},
+		Blue:         Bitfield{Offset: 0, Length: 5},
+	}
+	// Bytes in memory: B, G, R, X. What most fbdev drivers use at 32 bpp.
+	XRGB8888 = PixelFormat{
+		BitsPerPixel: 32,
+		Red:          Bitfield{Offset: 16, Length: 8},
+		Green:        Bitfield{Offset: 8, Length: 8},
+		Blue:         Bitfield{Offset: 0, Length: 8},
+	}
+	// Bytes in memory: A, R, G, B
+	BGRA8888 = PixelFormat{
+		BitsPerPixel: 32,
+		Red:          Bitfield{Offset: 8, Length: 8},
+		Green:        Bitfield{Offset: 16, Length: 8},
+		Blue:         Bitfield{Offset: 24, Length: 8},
+		Transp:       Bitfield{Offset: 0, Length: 8},
+	}
+)
+
+func (pf PixelFormat) String() string {
+	switch pf {
+	case RGB565:
+		return "RGB565"
+	case XRGB8888:
+		return "XRGB8888"
+	case BGRA8888:
+		return "BGRA8888"
+	}
+	return fmt.Sprintf("%dbpp r%d:%d g%d:%d b%d:%d a%d:%d", pf.BitsPerPixel,
+		pf.Red.Offset, pf.Red.Length, pf.Green.Offset, pf.Green.Length,
+		pf.Blue.Offset, pf.Blue.Length, pf.Transp.Offset, pf.Transp.Length)
+}
+
+// Alpha is ignored, screenshots are opaque
+func (pf PixelFormat) sameRGB(other PixelFormat) bool {
+	return pf.BitsPerPixel == other.BitsPerPixel && pf.Red == other.Red && pf.Green == other.Green && pf.Blue == other.Blue
+}
+
+func (pf PixelFormat) validate() error {
+	switch pf.BitsPerPixel {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("unsupported bits per pixel: %d", pf.BitsPerPixel)
+	}
+	for name, bf := range map[string]Bitfield{"red": pf.Red, "green": pf.Green, "blue": pf.Blue} {
+		if bf.Length == 0 || bf.Length > 8 || bf.Offset+bf.Length > pf.BitsPerPixel {
+			return fmt.Errorf("unsupported %s bitfield %d:%d at %d bpp", name, bf.Offset, bf.Length, pf.BitsPerPixel)
+		}
+	}
+	return nil
+}
+
+// Scales a channel of length bits up to 8 bits, repeating the high bits so
+// full intensity stays 0xff
+func expand(v uint32, length uint32) uint8 {
+	v <<= 8 - length
+	for shift := length; shift < 8; shift += length {
+		v |= v >> shift
+	}
+	return uint8(v)
+}
+
+func channel(px uint32, bf Bitfield) uint8 {
+	return expand((px>>bf.Offset)&(1<<bf.Length-1), bf.Length)
+}
+
+// ToImage converts raw framebuffer memory to an opaque RGBA image. stride is
+// the length of one line in bytes, which can be more than width pixels.
+func ToImage(pf PixelFormat, width int, height int, stride int, buf []byte) (*image.RGBA, error) {
+	if err := pf.validate(); err != nil {
+		return nil, err
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid geometry %dx%d", width, height)
+	}
+	bytesPerPixel := int(pf.BitsPerPixel / 8)
+	if stride < width*bytesPerPixel {
+		return nil, fmt.Errorf("stride %d too small for %d pixels of %d bytes", stride, width, bytesPerPixel)
+	}
+	if need := stride*(height-1) + width*bytesPerPixel; len(buf) < need {
+		return nil, fmt.Errorf("framebuffer too short: %d bytes, need %d", len(buf), need)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		line := buf[y*stride:]
+		out := img.Pix[y*img.Stride:]
+		switch {
+		case pf.sameRGB(XRGB8888):
+			for x := range width {
+				px := line[x*4:]
+				out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = px[2], px[1], px[0], 0xff
+			}
+		case pf.sameRGB(BGRA8888):
+			for x := range width {
+				px := line[x*4:]
+				out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = px[1], px[2], px[3], 0xff
+			}
+		default:
+			for x := range width {
+				var px uint32
+				switch bytesPerPixel {
+				case 2:
+					px = uint32(binary.LittleEndian.Uint16(line[x*2:]))
+				case 3:
+					px = uint32(line[x*3]) | uint32(line[x*3+1])<<8 | uint32(line[x*3+2])<<16
+				case 4:
+					px = binary.LittleEndian.Uint32(line[x*4:])
+				}
+				out[x*4] = channel(px, pf.Red)
+				out[x*4+1] = channel(px, pf.Green)
+				out[x*4+2] = channel(px, pf.Blue)
+				out[x*4+3] = 0xff
+			}
+		}
+	}
+	return img, nil
+}
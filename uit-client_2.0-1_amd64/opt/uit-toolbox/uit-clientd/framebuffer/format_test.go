@@ -0,0 +1,137 @@
+//go:build linux && amd64
+
+package framebuffer
+
+import (
+	"image/color"
+	"testing"
+)
+
+var (
+	white = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	black = color.RGBA{0, 0, 0, 0xff}
+	red   = color.RGBA{0xff, 0, 0, 0xff}
+	green = color.RGBA{0, 0xff, 0, 0xff}
+	blue  = color.RGBA{0, 0, 0xff, 0xff}
+)
+
+func TestToImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		pf     PixelFormat
+		width  int
+		height int
+		stride int
+		buf    []byte
+		want   []color.RGBA // row by row
+	}{
+		{
+			name: "RGB565", pf: RGB565, width: 2, height: 2, stride: 6,
+			buf: []byte{
+				0x00, 0xf8, 0xe0, 0x07, 0xaa, 0xaa, // red, green, padding
+				0x1f, 0x00, 0xff, 0xff, 0xaa, 0xaa, // blue, white, padding
+			},
+			want: []color.RGBA{red, green, blue, white},
+		},
+		{
+			// 0b10000 in 5 bits repeats its high bits to 0x84
+			name: "RGB565 half intensity", pf: RGB565, width: 1, height: 1, stride: 2,
+			buf:  []byte{0x00, 0x80},
+			want: []color.RGBA{{0x84, 0, 0, 0xff}},
+		},
+		{
+			name: "XRGB8888", pf: XRGB8888, width: 2, height: 2, stride: 12,
+			buf: []byte{
+				0x00, 0x00, 0xff, 0x00, 0x00, 0xff, 0x00, 0x00, 0xaa, 0xaa, 0xaa, 0xaa,
+				0xff, 0x00, 0x00, 0x00, 0x30, 0x20, 0x10, 0xff, 0xaa, 0xaa, 0xaa, 0xaa,
+			},
+			want: []color.RGBA{red, green, blue, {0x10, 0x20, 0x30, 0xff}},
+		},
+		{
+			name: "BGRA8888", pf: BGRA8888, width: 2, height: 1, stride: 8,
+			buf:  []byte{0x00, 0xff, 0x00, 0x00, 0x80, 0x10, 0x20, 0x30},
+			want: []color.RGBA{red, {0x10, 0x20, 0x30, 0xff}},
+		},
+		{
+			// Transparency does not change which fast path is taken
+			name: "XRGB8888 with alpha bitfield", pf: PixelFormat{
+				BitsPerPixel: 32,
+				Red:          XRGB8888.Red, Green: XRGB8888.Green, Blue: XRGB8888.Blue,
+				Transp: Bitfield{Offset: 24, Length: 8},
+			}, width: 1, height: 1, stride: 4,
+			buf:  []byte{0x30, 0x20, 0x10, 0x00},
+			want: []color.RGBA{{0x10, 0x20, 0x30, 0xff}},
+		},
+		{
+			// 5 bits per channel above one unused low bit
+			name: "RGBX5551", pf: PixelFormat{
+				BitsPerPixel: 16,
+				Red:          Bitfield{Offset: 11, Length: 5},
+				Green:        Bitfield{Offset: 6, Length: 5},
+				Blue:         Bitfield{Offset: 1, Length: 5},
+			}, width: 3, height: 1, stride: 8,
+			buf:  []byte{0x01, 0xf8, 0xc0, 0x07, 0x3e, 0x00, 0xaa, 0xaa},
+			want: []color.RGBA{red, green, blue},
+		},
+		{
+			name: "BGR888", pf: PixelFormat{
+				BitsPerPixel: 24,
+				Red:          Bitfield{Offset: 0, Length: 8},
+				Green:        Bitfield{Offset: 8, Length: 8},
+				Blue:         Bitfield{Offset: 16, Length: 8},
+			}, width: 2, height: 2, stride: 7,
+			buf: []byte{
+				0x10, 0x20, 0x30, 0x00, 0x00, 0x00, 0xaa,
+				0xff, 0xff, 0xff, 0x00, 0x00, 0xff, 0xaa,
+			},
+			want: []color.RGBA{{0x10, 0x20, 0x30, 0xff}, black, white, blue},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := ToImage(tt.pf, tt.width, tt.height, tt.stride, tt.buf)
+			if err != nil {
+				t.Fatalf("ToImage: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("bounds %v, want %dx%d", b, tt.width, tt.height)
+			}
+			for i, want := range tt.want {
+				x, y := i%tt.width, i/tt.width
+				if got := img.RGBAAt(x, y); got != want {
+					t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestToImageRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		pf     PixelFormat
+		width  int
+		height int
+		stride int
+		bufLen int
+	}{
+		{"bits per pixel", PixelFormat{BitsPerPixel: 8, Red: Bitfield{5, 3}, Green: Bitfield{2, 3}, Blue: Bitfield{0, 2}}, 1, 1, 1, 1},
+		{"bitfield too long", PixelFormat{BitsPerPixel: 32, Red: Bitfield{20, 10}, Green: Bitfield{10, 10}, Blue: Bitfield{0, 10}}, 1, 1, 4, 4},
+		{"bitfield outside pixel", PixelFormat{BitsPerPixel: 16, Red: Bitfield{12, 5}, Green: Bitfield{5, 6}, Blue: Bitfield{0, 5}}, 1, 1, 2, 2},
+		{"empty geometry", XRGB8888, 0, 1, 4, 4},
+		{"stride too small", XRGB8888, 2, 1, 4, 8},
+		{"buffer too short", RGB565, 2, 2, 6, 9},
+	}
+	for _, tt := range tests {
+		if _, err := ToImage(tt.pf, tt.width, tt.height, tt.stride, make([]byte, tt.bufLen)); err == nil {
+			t.Errorf("%s: ToImage succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestToImageLastLineWithoutPadding(t *testing.T) {
+	// The last line only needs width pixels, not a whole stride
+	if _, err := ToImage(RGB565, 2, 2, 6, make([]byte, 10)); err != nil {
+		t.Errorf("ToImage: %v", err)
+	}
+}
@@ -3,12 +3,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,12 +21,25 @@ import (
 	"time"
 
 	"uit-clientd/keypolicy"
+	"uit-clientd/logging"
+	"uit-clientd/pngstream"
+	"uit-clientd/requests"
+	"uit-clientd/retry"
 )
 
 var (
 	sharedHTTPClient   = newHTTPClient()
 	validHTTPMethodsMu = sync.RWMutex{}
 	validHTTPMethods   = []string{"GET", "POST", "DELETE"}
+	// Callers that loop on their own (enrollment, job polling) get a few
+	// quick retries here and back off on top of that
+	httpRetryPolicy = retry.Policy{
+		Name:            "http",
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     5 * time.Second,
+		MaxElapsed:      20 * time.Second,
+		MaxAttempts:     4,
+	}
 )
 
 const (
@@ -66,75 +78,115 @@ func newHTTPClient() *http.Client {
 	}
 }
 
-func newSinglePNGReader(src io.Reader) io.Reader {
-	pipeReader, pipeWriter := io.Pipe()
-
-	go func() {
-		err := streamSinglePNG(pipeWriter, src)
-		_ = pipeWriter.CloseWithError(err)
-	}()
-
-	return pipeReader
+// Screenshots come from a file or FIFO any local process can write to, so
+// every chunk is validated and metadata is dropped before upload
+func screenshotPNGLimits() pngstream.Limits {
+	limits := pngstream.DefaultLimits
+	limits.StripAncillary = true
+	if settings := daemonSettings.Load(); settings != nil && settings.ScreenshotMaxBytes > 0 {
+		limits.MaxBytes = settings.ScreenshotMaxBytes
+	}
+	return limits
 }
 
-func streamSinglePNG(dstWriter io.Writer, src io.Reader) error {
-	bufferReader := bufio.NewReader(src)
-
-	signature := make([]byte, 8)
-	if _, err := io.ReadFull(bufferReader, signature); err != nil {
-		return fmt.Errorf("failed to read PNG signature: %w", err)
+func screenshotStallTimeout() time.Duration {
+	if settings := daemonSettings.Load(); settings != nil && settings.ScreenshotStallTimeout > 0 {
+		return settings.ScreenshotStallTimeout
 	}
+	return 5 * time.Second
+}
 
-	// Defined in libpng/png.c: static const png_byte png_signature[8] = {137, 80, 78, 71, 13, 10, 26, 10};
-	pngSignature := []byte{137, 80, 78, 71, 13, 10, 26, 10}
-	if !bytes.Equal(signature, pngSignature) {
-		return fmt.Errorf("invalid PNG signature")
+// Reads a screenshot source, failing when no data arrives for timeout. A
+// writer that stops halfway through an image would otherwise block forever.
+type stallReader struct {
+	ctx     context.Context
+	file    *os.File
+	timeout time.Duration
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-	if _, err := dstWriter.Write(signature); err != nil {
-		return fmt.Errorf("failed to write PNG signature: %w", err)
+	// Regular files do not support deadlines, they never stall either
+	_ = r.file.SetReadDeadline(time.Now().Add(r.timeout))
+	n, err := r.file.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if ctxErr := r.ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+		return n, fmt.Errorf("screenshot source '%s' stalled for %s: %w", r.file.Name(), r.timeout, err)
 	}
+	return n, err
+}
 
-	for {
-		headerSignature := make([]byte, 8)
-		if _, err := io.ReadFull(bufferReader, headerSignature); err != nil {
-			return fmt.Errorf("failed to read PNG chunk header: %w", err)
-		}
+// A validated PNG streamed from src as a request body. The pipe only hands
+// over a chunk once the transport has sent the previous one, so memory use
+// stays at one chunk no matter how large the image is.
+type singlePNGReader struct {
+	*io.PipeReader
+	done chan struct{}
+	err  error // valid once done is closed
+}
 
-		if _, err := dstWriter.Write(headerSignature); err != nil {
-			return fmt.Errorf("failed to write PNG chunk header: %w", err)
-		}
+// Takes ownership of src and closes it when the PNG is read or ctx is done
+func newSinglePNGReader(ctx context.Context, src *os.File) *singlePNGReader {
+	pipeReader, pipeWriter := io.Pipe()
+	r := &singlePNGReader{PipeReader: pipeReader, done: make(chan struct{})}
+	stop := context.AfterFunc(ctx, func() { _ = src.SetReadDeadline(time.Now()) })
 
-		// big-endian classification in libpng/manuals/libpng-manual.txt line 3491
-		chunkLen := binary.BigEndian.Uint32(headerSignature[:4])
-		chunkType := string(headerSignature[4:8])
+	go func() {
+		defer close(r.done)
+		defer src.Close()
+		defer stop()
+		err := streamSinglePNG(pipeWriter, &stallReader{ctx: ctx, file: src, timeout: screenshotStallTimeout()})
+		r.err = err
+		_ = pipeWriter.CloseWithError(err)
+	}()
 
-		if _, err := io.CopyN(dstWriter, bufferReader, int64(chunkLen)+4); err != nil {
-			return fmt.Errorf("failed to stream PNG chunk payload: %w", err)
-		}
+	return r
+}
 
-		if chunkType == "IEND" {
-			return nil
+// Waits for the source side to finish, returns why it failed if it did
+func (r *singlePNGReader) sourceErr() error {
+	<-r.done
+	return r.err
+}
+
+func streamSinglePNG(dstWriter io.Writer, src io.Reader) error {
+	if _, err := pngstream.Copy(dstWriter, src, screenshotPNGLimits()); err != nil {
+		if errors.Is(err, io.ErrClosedPipe) {
+			return err // upload ended first, not a problem with the PNG
 		}
+		return fmt.Errorf("cannot stream PNG: %w", err)
 	}
+	return nil
 }
 
 func sendHTTPRequest(ctx context.Context, data *HTTPRequest) ([]byte, error) {
+	body, _, err := sendHTTPRequestStatus(ctx, data)
+	return body, err
+}
+
+// Same as sendHTTPRequest, also returns the HTTP status of the last response,
+// 0 if the server never answered
+func sendHTTPRequestStatus(ctx context.Context, data *HTTPRequest) ([]byte, int, error) {
 	if data == nil || data.Config == nil {
-		return nil, fmt.Errorf("data variable and/or config is nil")
+		return nil, 0, fmt.Errorf("data variable and/or config is nil")
 	}
 	validHTTPMethodsMu.RLock()
 	if !slices.Contains(validHTTPMethods, data.Config.Method) {
 		validHTTPMethodsMu.RUnlock()
-		return nil, fmt.Errorf("unsupported HTTP method: %s", data.Config.Method)
+		return nil, 0, fmt.Errorf("unsupported HTTP method: %s", data.Config.Method)
 	}
 	validHTTPMethodsMu.RUnlock()
 	
 	if strings.TrimSpace(data.Config.URL.Path) == "" {
-		return nil, fmt.Errorf("relative URL cannot be empty")
+		return nil, 0, fmt.Errorf("relative URL cannot be empty")
 	}
 
 	if data.Config.URL.Path == "" {
-		return nil, fmt.Errorf("URL path cannot be empty")
+		return nil, 0, fmt.Errorf("URL path cannot be empty")
 	}
 
 	requestURL := &url.URL{
@@ -151,99 +203,122 @@ func sendHTTPRequest(ctx context.Context, data *HTTPRequest) ([]byte, error) {
 	}
 
 	if data.Config.URL.Host != "" {
+		if data.Config.URL.Scheme != "" {
+			requestURL.Scheme = data.Config.URL.Scheme
+		}
 		requestURL.Host = data.Config.URL.Host
 	} else {
-		tmpConfig := clientConfig.Load()
-		if tmpConfig == nil {
-			return nil, fmt.Errorf("client config is not loaded, cannot send request")
-		}
-		if strings.TrimSpace(tmpConfig.UIT_WEB_HTTPS_HOST) == "" || strings.TrimSpace(tmpConfig.UIT_WEB_HTTPS_PORT) == "" {
-			return nil, fmt.Errorf("client config has invalid host or port for HTTPS")
+		endpoint, err := requests.ServerURL()
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot send request: %w", err)
 		}
-		requestURL.Host = fmt.Sprintf("%s:%s", tmpConfig.UIT_WEB_HTTPS_HOST, tmpConfig.UIT_WEB_HTTPS_PORT)
+		requestURL.Scheme = endpoint.Scheme
+		requestURL.Host = endpoint.Host
 	}
 
-	// HTTP body
-	var bodyReader io.Reader = http.NoBody
-	var bodyCloser io.Closer
+	// HTTP body, kept in memory so every retry can resend it
+	var body []byte
+	// Streamed screenshot, cannot be replayed so it only gets one attempt
+	var upload *singlePNGReader
+	policy := httpRetryPolicy
 	if data.Config.Method == "POST" {
+		// Job stats and the like would be recorded twice
+		policy.Classify = retry.IsRetryableUnsent
 		if data.Payload == nil {
-			return nil, fmt.Errorf("payload cannot be nil")
+			return nil, 0, fmt.Errorf("payload cannot be nil")
 		}
 		if data.Payload.RequestType == "POST" && data.Payload.Value == nil {
-			return nil, fmt.Errorf("payload value cannot be nil")
+			return nil, 0, fmt.Errorf("payload value cannot be nil")
 		}
 		if strings.EqualFold(data.Config.ContentType, "application/octet-stream") {
 			if data.Payload.Key == "live_screenshot" {
 				pngPath := strings.TrimSpace(data.Payload.StringValue)
 				if pngPath == "" {
-					return nil, fmt.Errorf("live_screenshot requires a PNG file path in string_value")
+					return nil, 0, fmt.Errorf("live_screenshot requires a PNG file path in string_value")
 				}
 				file, err := os.Open(pngPath)
 				if err != nil {
-					return nil, fmt.Errorf("unable to open screenshot file: %w", err)
+					return nil, 0, fmt.Errorf("unable to open screenshot file: %w", err)
 				}
-				bodyCloser = file
-
-				var pngBuffer bytes.Buffer
-				if err := streamSinglePNG(&pngBuffer, file); err != nil {
-					return nil, fmt.Errorf("unable to buffer PNG screenshot: %w", err)
-				}
-				bodyReader = bytes.NewReader(pngBuffer.Bytes())
+				upload = newSinglePNGReader(ctx, file)
+				defer upload.Close()
+				policy.MaxAttempts = 1
 			} else {
 				imageBytes, ok := data.Payload.Value.([]byte)
 				if !ok {
-					return nil, fmt.Errorf("octet-stream payload value must be []byte")
+					return nil, 0, fmt.Errorf("octet-stream payload value must be []byte")
 				}
-				bodyReader = bytes.NewReader(imageBytes)
+				body = imageBytes
 			}
 		} else {
 			jsonData, err := json.Marshal(data.Payload.Value)
 			if err != nil {
-				return nil, fmt.Errorf("failed to marshal data: %w", err)
+				return nil, 0, fmt.Errorf("failed to marshal data: %w", err)
 			}
-			bodyReader = bytes.NewReader(jsonData)
+			body = jsonData
 		}
 	}
 
-	// HTTP request
-	req, err := http.NewRequestWithContext(ctx, data.Config.Method, requestURL.String(), bodyReader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	if bodyCloser != nil {
-		defer bodyCloser.Close()
-	}
-
-	// HTTP headers
-	if data.Config.ContentType != "" {
-		req.Header.Set("Content-Type", data.Config.ContentType)
-	} else {
-		req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	}
-	req.Header.Set("User-Agent", "UIT-Client-CLI Daemon")
+	log := logging.Component("http").With(payloadAttrs(data.Payload)...)
+	var respBody []byte
+	status := 0
+	err := retry.Do(ctx, policy, func(ctx context.Context) error {
+		// HTTP request
+		var bodyReader io.Reader = http.NoBody
+		if upload != nil {
+			bodyReader = upload
+		} else if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, data.Config.Method, requestURL.String(), bodyReader)
+		if err != nil {
+			return retry.Permanent(fmt.Errorf("failed to create request: %w", err))
+		}
+		if upload != nil {
+			req.ContentLength = -1 // size unknown until IEND, sent in chunks
+		}
 
-	// Server response
-	if ctx.Err() != nil {
-		return nil, ctx.Err()
-	}
+		// HTTP headers
+		if data.Config.ContentType != "" {
+			req.Header.Set("Content-Type", data.Config.ContentType)
+		} else {
+			req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		}
+		req.Header.Set("User-Agent", "UIT-Client-CLI Daemon")
 
-	resp, err := sharedHTTPClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
+		// Server response
+		start := time.Now()
+		resp, err := sharedHTTPClient.Do(req)
+		if err != nil {
+			log.Debug("request failed", "method", req.Method, "path", req.URL.Path, logging.Latency(time.Since(start)), "error", err)
+			if upload != nil {
+				if srcErr := upload.sourceErr(); srcErr != nil && !errors.Is(srcErr, io.ErrClosedPipe) {
+					return retry.Permanent(fmt.Errorf("screenshot upload aborted: %w", srcErr))
+				}
+			}
+			requests.RecordServerResponse(req.Method, 0, time.Since(start), err)
+			return fmt.Errorf("request failed: %w", err)
+		}
+		requests.RecordServerResponse(req.Method, resp.StatusCode, time.Since(start), nil)
+		status = resp.StatusCode
+		defer resp.Body.Close()
+		log.Debug("response", "method", req.Method, "path", req.URL.Path, "status", resp.StatusCode, logging.Latency(time.Since(start)))
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("server returned an HTTP error: %d", resp.StatusCode)
-	}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return retry.NewStatusError(resp)
+		}
 
-	body, err := io.ReadAll(resp.Body)
+		respBody, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response body: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, status, err
 	}
 
-	return body, nil
+	return respBody, status, nil
 }
 
 func MapInputToHTTPRequest(input string) (*HTTPRequest, error) {
@@ -278,7 +353,8 @@ func MapInputToHTTPRequest(input string) (*HTTPRequest, error) {
 
 	if rule.BypassHTTP {
 		pl := &HTTPRequestPayload{
-			Key: inputPayload.Key,
+			Key:         inputPayload.Key,
+			StringValue: inputPayload.StringValue,
 		}
 		return &HTTPRequest{
 			Payload: pl,
@@ -697,6 +773,20 @@ func MapInputToHTTPRequest(input string) (*HTTPRequest, error) {
 			TransactionUUID: *inputPayload.TransactionUUID,
 			DiskFirmware:    &inputPayload.StringValue,
 		}
+	case "disk_max_temp":
+		httpRequestConfig.URL = url.URL{Path: "/api/client/disk/temp"}
+		diskMaxTemp, err := strconv.ParseFloat(inputPayload.StringValue, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse disk_max_temp value: %w", err)
+		}
+		if diskMaxTemp < 0 || diskMaxTemp > 200 {
+			return nil, fmt.Errorf("disk_max_temp value out of range (degrees C): %f", diskMaxTemp)
+		}
+		inputPayload.Value = &DiskTempData{
+			Tagnumber:    tagnumber,
+			SystemSerial: systemSerial,
+			MaxTemp:      &diskMaxTemp,
+		}
 	case "disk_model":
 		httpRequestConfig.URL = url.URL{Path: "/api/client/hardware"}
 		inputPayload.Value = &ClientHardwareView{
@@ -781,6 +871,20 @@ func MapInputToHTTPRequest(input string) (*HTTPRequest, error) {
 			TransactionUUID: *inputPayload.TransactionUUID,
 			DiskSize:        &diskSizeKB,
 		}
+	case "disk_temp":
+		httpRequestConfig.URL = url.URL{Path: "/api/client/disk/temp"}
+		diskTemp, err := strconv.ParseFloat(inputPayload.StringValue, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse disk_temp value: %w", err)
+		}
+		if diskTemp < 0 || diskTemp > 200 {
+			return nil, fmt.Errorf("disk_temp value out of range (degrees C): %f", diskTemp)
+		}
+		inputPayload.Value = &DiskTempData{
+			Tagnumber:    tagnumber,
+			SystemSerial: systemSerial,
+			Temp:         &diskTemp,
+		}
 	case "disk_type":
 		httpRequestConfig.URL = url.URL{Path: "/api/client/hardware"}
 		inputPayload.Value = &ClientHardwareView{
@@ -893,6 +997,25 @@ func MapInputToHTTPRequest(input string) (*HTTPRequest, error) {
 			TransactionUUID: *inputPayload.TransactionUUID,
 			JobStartTime:    &jobStartTime,
 		}
+	case "live_console":
+		httpRequestConfig.URL = url.URL{Path: "/api/client/live_console"}
+		httpRequestConfig.URL.RawQuery = requests.ClientQuery(inputPayload.Tagnumber, inputPayload.SystemSerial).Encode()
+		if len(inputPayload.StringValue) > maxLiveConsoleSize {
+			return nil, fmt.Errorf("live_console value too large: %d bytes, limit %d", len(inputPayload.StringValue), maxLiveConsoleSize)
+		}
+		var console LiveConsoleData
+		if err := json.Unmarshal([]byte(inputPayload.StringValue), &console); err != nil {
+			return nil, fmt.Errorf("unable to parse live_console value: %w", err)
+		}
+		if console.Format != "text" && console.Format != "ansi" {
+			return nil, fmt.Errorf("live_console format must be text or ansi: '%s'", console.Format)
+		}
+		if console.Lines <= 0 || console.Columns <= 0 {
+			return nil, fmt.Errorf("live_console size out of range: %dx%d", console.Columns, console.Lines)
+		}
+		console.Tagnumber = tagnumber
+		console.SystemSerial = systemSerial
+		inputPayload.Value = &console
 	case "live_screenshot":
 		httpRequestConfig.URL = url.URL{Path: "/api/client/live_screenshot"}
 		httpRequestConfig.Method = "POST"
@@ -0,0 +1,90 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+)
+
+// Sends one keypolicy key for this client, the same way a socket request
+// would. The tag number is left out until enrollment assigns one, so only keys
+// that do not require it can be sent before that.
+func sendClientKey(ctx context.Context, key string, value string) error {
+	serial := systemSerial.Load()
+	if serial == nil {
+		return fmt.Errorf("no serial yet")
+	}
+	tag := tagnumber.Load()
+	line, err := json.Marshal(HTTPRequestPayload{
+		RequestType:  "POST",
+		Tagnumber:    tag,
+		SystemSerial: *serial,
+		Key:          key,
+		StringValue:  value,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal %s: %w", key, err)
+	}
+	httpRequest, err := MapInputToHTTPRequest(string(line))
+	if err != nil {
+		return err
+	}
+	_, err = sendHTTPRequest(ctx, httpRequest)
+	return err
+}
+
+// Reads the NVMe temperature and sends the current and max temperature as
+// separate keys. The battery charge is already in the live data document.
+// Systems without an NVMe sensor are skipped, every other failure is returned.
+func reportHardware(ctx context.Context) error {
+	var errs []error
+
+	diskTemp, diskMaxTemp, err := requests.GetDiskData()
+	switch {
+	case errors.Is(err, requests.ErrNoDiskSensor):
+	case err != nil:
+		errs = append(errs, err)
+	default:
+		if err := sendClientKey(ctx, "disk_temp", strconv.FormatFloat(diskTemp, 'f', -1, 64)); err != nil {
+			errs = append(errs, fmt.Errorf("disk_temp: %w", err))
+		}
+		if diskMaxTemp > 0 {
+			if err := sendClientKey(ctx, "disk_max_temp", strconv.FormatFloat(diskMaxTemp, 'f', -1, 64)); err != nil {
+				errs = append(errs, fmt.Errorf("disk_max_temp: %w", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reports the disk temperature every interval until ctx is done. It is keyed
+// by serial until the client has a tag number.
+func runHardwareReporter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := reportHardware(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			lifecycle.count(func(c *LifecycleCounters) { c.HardwareReportErrors++ })
+			logging.Component("hardware_report").Warn("hardware report failed", "error", err)
+			continue
+		}
+		lifecycle.count(func(c *LifecycleCounters) { c.HardwareReports++ })
+	}
+}
@@ -0,0 +1,87 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"uit-clientd/requests"
+)
+
+// PublishedJobState is what gets written to the job queue data path. The job
+// fields stay at the top level so existing jq filters keep working.
+type PublishedJobState struct {
+	requests.ClientJobQueueDataResponse
+	Sequence    uint64    `json:"sequence"`
+	LastChanged time.Time `json:"last_changed"`
+}
+
+// Writes the job queue data atomically, and only when it changed
+type jobStatePublisher struct {
+	mu          sync.Mutex
+	path        string
+	sequence    uint64
+	lastChanged time.Time
+	last        []byte // JSON of the last published ClientJobQueueDataResponse
+}
+
+// Picks up the sequence from a file left by a previous run, so it keeps counting up
+func newJobStatePublisher(path string) *jobStatePublisher {
+	p := &jobStatePublisher{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p
+	}
+	var prev PublishedJobState
+	if err := json.Unmarshal(data, &prev); err != nil {
+		return p
+	}
+	p.sequence = prev.Sequence
+	p.lastChanged = prev.LastChanged
+	if last, err := json.Marshal(prev.ClientJobQueueDataResponse); err == nil {
+		p.last = last
+	}
+	return p
+}
+
+// Publishes jqd if it differs from the last published state, returns the
+// sequence number of the state on disk
+func (p *jobStatePublisher) publish(jqd requests.ClientJobQueueDataResponse) (seq uint64, changed bool, err error) {
+	current, err := json.Marshal(jqd)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot marshal ClientJobQueueDataResponse JSON (publish): %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sequence, lastChanged := p.sequence, p.lastChanged
+	if p.last != nil && bytes.Equal(current, p.last) {
+		if _, err := os.Stat(p.path); err == nil {
+			return p.sequence, false, nil
+		}
+		// Removed by someone else, write it again without bumping the sequence
+	} else {
+		sequence++
+		lastChanged = time.Now()
+	}
+
+	out, err := json.Marshal(PublishedJobState{
+		ClientJobQueueDataResponse: jqd,
+		Sequence:                   sequence,
+		LastChanged:                lastChanged,
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot marshal published job state: %w", err)
+	}
+	if err := writeFileAtomic(p.path, out, 0644); err != nil {
+		// Nothing is committed, so the next poll tries again
+		return 0, false, fmt.Errorf("error writing client job queue data to disk: %w", err)
+	}
+	p.sequence, p.lastChanged, p.last = sequence, lastChanged, current
+	return sequence, true, nil
+}
@@ -0,0 +1,218 @@
+//go:build linux && amd64
+
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcomes of a request
+const (
+	OutcomeSent     = "sent"     // the server accepted it
+	OutcomeQueued   = "queued"   // durable request waiting in the outbox
+	OutcomeLocal    = "local"    // answered by uit-clientd itself
+	OutcomeRejected = "rejected" // failed validation, never sent
+	OutcomeFailed   = "failed"   // sent, but the server or network failed
+	OutcomeDropped  = "dropped"  // given up on for good
+)
+
+// Entry is one request outcome
+type Entry struct {
+	Time            time.Time `json:"time"`
+	Source          string    `json:"source"` // socket or outbox
+	Key             string    `json:"key"`
+	Method          string    `json:"method,omitempty"`
+	TransactionUUID string    `json:"transaction_uuid,omitempty"`
+	Validation      string    `json:"validation"` // ok or why the request was rejected
+	Outcome         string    `json:"outcome"`
+	HTTPStatus      int       `json:"http_status,omitempty"`
+	LatencyMS       float64   `json:"latency_ms"`
+	Error           string    `json:"error,omitempty"`
+	// Only kept for keys whose policy allows it
+	Value    string `json:"value,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// Filter selects entries in Query. Zero fields match everything.
+type Filter struct {
+	Key             string
+	TransactionUUID string
+	Since           time.Time
+	Until           time.Time
+	Limit           int // newest entries only
+}
+
+func (f Filter) match(e *Entry) bool {
+	switch {
+	case f.Key != "" && e.Key != f.Key:
+		return false
+	case f.TransactionUUID != "" && e.TransactionUUID != f.TransactionUUID:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Time.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// Journal is a JSON lines file that is rotated once it reaches maxBytes.
+// Rotated files are kept as path.1 (newest) to path.N.
+type Journal struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// Open opens or creates the journal at path
+func Open(path string, maxBytes int64, backups int) (*Journal, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("journal size must be greater than 0: %d", maxBytes)
+	}
+	j := &Journal{path: path, maxBytes: maxBytes, backups: max(backups, 1)}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("cannot create directory for '%s': %w", path, err)
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Called with j.mu held
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open journal '%s': %w", j.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot stat journal '%s': %w", j.path, err)
+	}
+	j.file, j.size = f, info.Size()
+	return nil
+}
+
+func (j *Journal) backupPath(n int) string {
+	return j.path + "." + strconv.Itoa(n)
+}
+
+// Called with j.mu held
+func (j *Journal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return fmt.Errorf("cannot close journal '%s': %w", j.path, err)
+	}
+	j.file = nil
+	_ = os.Remove(j.backupPath(j.backups))
+	for n := j.backups - 1; n >= 1; n-- {
+		if err := os.Rename(j.backupPath(n), j.backupPath(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot rotate journal: %w", err)
+		}
+	}
+	if err := os.Rename(j.path, j.backupPath(1)); err != nil {
+		return fmt.Errorf("cannot rotate journal: %w", err)
+	}
+	return j.open()
+}
+
+// Append writes e as one line, rotating first if the line would not fit
+func (j *Journal) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot marshal journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		// A failed rotation left no file open, try again
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+	if j.size > 0 && j.size+int64(len(line)) > j.maxBytes {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write journal '%s': %w", j.path, err)
+	}
+	return nil
+}
+
+// Query returns the entries matching f, oldest first
+func (j *Journal) Query(f Filter) ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var entries []Entry
+	for n := j.backups; n >= 0; n-- {
+		path := j.path
+		if n > 0 {
+			path = j.backupPath(n)
+		}
+		if err := readEntries(path, f, &entries); err != nil {
+			return nil, err
+		}
+	}
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, nil
+}
+
+func readEntries(path string, f Filter, entries *[]Entry) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open journal '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		// A line cut short by a crash is skipped, not fatal
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if f.match(&e) {
+			*entries = append(*entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read journal '%s': %w", path, err)
+	}
+	return nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,218 @@
+//go:build linux && amd64
+
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+
+// Entries all marshal to the same length, i is kept in Key
+func testEntry(i int) Entry {
+	return Entry{
+		Time:       start.Add(time.Duration(i) * time.Minute),
+		Source:     "socket",
+		Key:        fmt.Sprintf("key_%03d", i),
+		Validation: "ok",
+		Outcome:    OutcomeSent,
+	}
+}
+
+func lineLength(t *testing.T) int64 {
+	t.Helper()
+	line, err := json.Marshal(testEntry(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line) + 1)
+}
+
+func keys(entries []Entry) []string {
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.Key
+	}
+	return out
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "requests.jsonl")
+	// Three entries per file, the current file and two backups
+	j, err := Open(path, 3*lineLength(t), 2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+
+	for i := range 10 {
+		if err := j.Append(testEntry(i)); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+
+	// 9 is in the current file, 3-5 and 6-8 in the backups, 0-2 are gone
+	for _, tt := range []struct {
+		path  string
+		lines int64
+	}{
+		{path, 1},
+		{path + ".1", 3},
+		{path + ".2", 3},
+	} {
+		info, err := os.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if info.Size() != tt.lines*lineLength(t) {
+			t.Errorf("%s is %d bytes, want %d lines", tt.path, info.Size(), tt.lines)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want at most 2 backups", path)
+	}
+
+	entries, err := j.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	want := []string{"key_003", "key_004", "key_005", "key_006", "key_007", "key_008", "key_009"}
+	if got := keys(entries); !slices.Equal(got, want) {
+		t.Errorf("Query = %v, want %v", got, want)
+	}
+}
+
+func TestReopenKeepsSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	maxBytes := 2 * lineLength(t)
+	j, err := Open(path, maxBytes, 1)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := j.Append(testEntry(0)); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	j, err = Open(path, maxBytes, 1)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer j.Close()
+	for i := 1; i <= 2; i++ {
+		if err := j.Append(testEntry(i)); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+	// The second entry after reopening no longer fits next to the first two
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("journal not rotated after reopening: %v", err)
+	}
+}
+
+func TestOversizedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	j, err := Open(path, 10, 1)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+	// An entry larger than the limit still gets a file of its own
+	for i := range 2 {
+		if err := j.Append(testEntry(i)); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+	entries, err := j.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if got := keys(entries); !slices.Equal(got, []string{"key_000", "key_001"}) {
+		t.Errorf("Query = %v", got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	j, err := Open(path, 4*lineLength(t), 3)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+	for i := range 8 {
+		e := testEntry(i)
+		if i%2 == 0 {
+			e.Key = "even"
+			e.TransactionUUID = "uuid-even"
+		}
+		if err := j.Append(e); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"all", Filter{}, []string{"even", "key_001", "even", "key_003", "even", "key_005", "even", "key_007"}},
+		{"key", Filter{Key: "key_003"}, []string{"key_003"}},
+		{"transaction UUID", Filter{TransactionUUID: "uuid-even"}, []string{"even", "even", "even", "even"}},
+		{"since", Filter{Since: start.Add(5 * time.Minute)}, []string{"key_005", "even", "key_007"}},
+		{"until", Filter{Until: start.Add(time.Minute)}, []string{"even", "key_001"}},
+		{"since and until", Filter{Since: start.Add(2 * time.Minute), Until: start.Add(3 * time.Minute)}, []string{"even", "key_003"}},
+		{"limit keeps the newest", Filter{Limit: 3}, []string{"key_005", "even", "key_007"}},
+		{"limit after filtering", Filter{Key: "even", Limit: 2}, []string{"even", "even"}},
+		{"no match", Filter{Key: "other"}, nil},
+	}
+	for _, tt := range tests {
+		entries, err := j.Query(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", tt.name, err)
+		}
+		if got := keys(entries); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Query = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Limit applies after filtering, so the two newest even entries are 4 and 6
+	entries, _ := j.Query(Filter{Key: "even", Limit: 2})
+	if len(entries) == 2 && (!entries[0].Time.Equal(start.Add(4*time.Minute)) || !entries[1].Time.Equal(start.Add(6*time.Minute))) {
+		t.Errorf("limit kept %s and %s, want the two newest", entries[0].Time, entries[1].Time)
+	}
+}
+
+func TestQuerySkipsBrokenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	line, _ := json.Marshal(testEntry(1))
+	content := "{\"time\": \"2026-03-04T05:06:07Z\", \"key\": \"cut sh\n" + string(line) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := Open(path, 1<<20, 1)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+	entries, err := j.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if got := keys(entries); !slices.Equal(got, []string{"key_001"}) {
+		t.Errorf("Query = %v, want [key_001]", got)
+	}
+}
+
+func TestOpenRejectsZeroSize(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "requests.jsonl"), 0, 1); err == nil {
+		t.Error("Open with a zero size succeeded")
+	}
+}
@@ -13,6 +13,9 @@ type Policy struct {
 	RequiresUUID   bool
 	RequiresValue  bool
 	BypassHTTP     bool
+	Durable        bool // queued on disk until the server accepts it
+	NoJournal      bool // read-only query, left out of the request journal
+	LogValue       bool // value is kept in the request journal, redacted otherwise
 }
 
 var policies = map[string]Policy{
@@ -30,7 +33,7 @@ var policies = map[string]Policy{
 	"chassis_type":                 {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"client_app_uptime":            {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: false, RequiresValue: true},
 	"client_lookup_by_serial":      {Method: "GET", RequiresSerial: true, RequiresTag: false, RequiresUUID: false, RequiresValue: false},
-	"clone_completed":              {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"clone_completed":              {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true, Durable: true, LogValue: true},
 	"clone_image_name":             {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"clone_job_duration":           {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"clone_master":                 {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
@@ -46,6 +49,7 @@ var policies = map[string]Policy{
 	"disk_errors":                  {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_firmware":                {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_image_name":              {Method: "GET", RequiresSerial: false, RequiresTag: false, RequiresUUID: false, RequiresValue: true},
+	"disk_max_temp":                {Method: "POST", RequiresSerial: true, RequiresTag: false, RequiresUUID: false, RequiresValue: true},
 	"disk_model":                   {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_name":                    {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_power_cycles":            {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
@@ -53,16 +57,20 @@ var policies = map[string]Policy{
 	"disk_reads_kb":                {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_serial":                  {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_size_kb":                 {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"disk_temp":                    {Method: "POST", RequiresSerial: true, RequiresTag: false, RequiresUUID: false, RequiresValue: true},
 	"disk_type":                    {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"disk_writes_kb":               {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
-	"erase_completed":              {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"enrollment_status":            {Method: "GET", BypassHTTP: true, NoJournal: true},
+	"erase_completed":              {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true, Durable: true, LogValue: true},
 	"erase_disk_pcnt":              {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"erase_job_duration":           {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
-	"erase_mode":                   {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"erase_mode":                   {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true, LogValue: true},
 	"ethernet_mac":                 {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"history":                      {Method: "GET", BypassHTTP: true, NoJournal: true},
 	"init":                         {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: false},
-	"job_cancelled":                {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"job_cancelled":                {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true, Durable: true, LogValue: true},
 	"job_start_time":               {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"live_console":                 {Method: "POST", RequiresSerial: true, RequiresTag: false, RequiresUUID: false, RequiresValue: true},
 	"live_screenshot":              {Method: "POST", RequiresSerial: false, RequiresTag: true, RequiresUUID: false, RequiresValue: true},
 	"memory_capacity_kb":           {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"memory_serial":                {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
@@ -71,12 +79,16 @@ var policies = map[string]Policy{
 	"motherboard_manufacturer":     {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"motherboard_serial":           {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"new_transaction_uuid":         {Method: "GET", BypassHTTP: true},
+	"retry_stats":                  {Method: "GET", BypassHTTP: true, NoJournal: true},
+	"status":                       {Method: "GET", BypassHTTP: true, NoJournal: true},
+	"subscribe":                    {Method: "GET", BypassHTTP: true, NoJournal: true},
 	"system_manufacturer":          {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"system_model":                 {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"system_sku":                   {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"system_uptime":                {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: false, RequiresValue: true},
 	"system_uuid":                  {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 	"tpm_version":                  {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
+	"usage_history":                {Method: "GET", RequiresValue: true, BypassHTTP: true, NoJournal: true},
 	"wifi_mac":                     {Method: "POST", RequiresSerial: true, RequiresTag: true, RequiresUUID: true, RequiresValue: true},
 }
 
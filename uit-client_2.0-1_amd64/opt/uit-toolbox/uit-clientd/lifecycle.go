@@ -0,0 +1,205 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/retry"
+)
+
+type LifecyclePhase string
+
+const (
+	PhaseStarting      LifecyclePhase = "starting"
+	PhaseWaitingConfig LifecyclePhase = "waiting_config"
+	PhaseWaitingSerial LifecyclePhase = "waiting_serial"
+	PhaseWaitingTag    LifecyclePhase = "waiting_tag"
+	PhasePolling       LifecyclePhase = "polling"
+	PhaseDegraded      LifecyclePhase = "degraded"
+	PhaseStopping      LifecyclePhase = "stopping"
+)
+
+// PhaseInfo is kept for every phase the daemon has been in
+type PhaseInfo struct {
+	Entered     time.Time  `json:"entered"`
+	Count       int64      `json:"count"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type LifecycleCounters struct {
+	JobPolls               int64 `json:"job_polls"`
+	JobPollFailures        int64 `json:"job_poll_failures"`
+	ConfigReloads          int64 `json:"config_reloads"`
+	ConfigReloadFailures   int64 `json:"config_reload_failures"`
+	TelemetryReports       int64 `json:"telemetry_reports"`
+	TelemetryFailures      int64 `json:"telemetry_failures"`
+	HardwareReports        int64 `json:"hardware_reports"`
+	HardwareReportErrors   int64 `json:"hardware_report_errors"`
+	ScreenshotsSent        int64 `json:"screenshots_sent"`
+	ScreenshotsSkipped     int64 `json:"screenshots_skipped"` // unchanged frames
+	ConsoleCapturesSent    int64 `json:"console_captures_sent"`
+	ConsoleCapturesSkipped int64 `json:"console_captures_skipped"`
+}
+
+// DaemonStatus is returned as JSON for the status socket key
+type DaemonStatus struct {
+	Phase        LifecyclePhase                `json:"phase"`
+	PhaseSince   time.Time                     `json:"phase_since"`
+	Ready        bool                          `json:"ready"`
+	ReadySince   *time.Time                    `json:"ready_since,omitempty"`
+	StartedAt    time.Time                     `json:"started_at"`
+	SystemSerial string                        `json:"system_serial,omitempty"`
+	Tagnumber    int64                         `json:"tagnumber,omitempty"`
+	ConfigStale  bool                          `json:"config_stale"`
+	HasConfig    bool                          `json:"has_config"`
+	Phases       map[LifecyclePhase]*PhaseInfo `json:"phases"`
+	Counters     LifecycleCounters             `json:"counters"`
+	Enrollment   *EnrollmentStatus             `json:"enrollment,omitempty"`
+	Outbox       int                           `json:"outbox_pending"`
+	Retries      map[string]retry.Stats        `json:"retries"`
+}
+
+type lifecycleTracker struct {
+	mu         sync.Mutex
+	phase      LifecyclePhase
+	phaseSince time.Time
+	startedAt  time.Time
+	readySince *time.Time
+	phases     map[LifecyclePhase]*PhaseInfo
+	counters   LifecycleCounters
+}
+
+var lifecycle = newLifecycleTracker()
+
+func newLifecycleTracker() *lifecycleTracker {
+	now := time.Now()
+	return &lifecycleTracker{
+		phase:      PhaseStarting,
+		phaseSince: now,
+		startedAt:  now,
+		phases: map[LifecyclePhase]*PhaseInfo{
+			PhaseStarting: {Entered: now, Count: 1},
+		},
+	}
+}
+
+func (l *lifecycleTracker) phaseInfo(phase LifecyclePhase) *PhaseInfo {
+	info, ok := l.phases[phase]
+	if !ok {
+		info = &PhaseInfo{}
+		l.phases[phase] = info
+	}
+	return info
+}
+
+// Moves to a new phase, stopping is final
+func (l *lifecycleTracker) setPhase(phase LifecyclePhase) {
+	l.mu.Lock()
+	if l.phase == phase || l.phase == PhaseStopping {
+		l.mu.Unlock()
+		return
+	}
+	prev := l.phase
+	now := time.Now()
+	l.phase = phase
+	l.phaseSince = now
+	info := l.phaseInfo(phase)
+	info.Entered = now
+	info.Count++
+	l.mu.Unlock()
+
+	logging.Component("lifecycle").Info("phase changed", "from", prev, "to", phase)
+	state := "STATUS=" + string(phase)
+	if phase == PhaseStopping {
+		state = "STOPPING=1\n" + state
+	}
+	if err := sdNotify(state); err != nil {
+		logging.Component("systemd").Error("sd_notify failed", "error", err)
+	}
+}
+
+func (l *lifecycleTracker) current() LifecyclePhase {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.phase
+}
+
+// Records the last error seen while working on a phase
+func (l *lifecycleTracker) recordError(phase LifecyclePhase, err error) {
+	if err == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	info := l.phaseInfo(phase)
+	info.LastError = err.Error()
+	info.LastErrorAt = &now
+}
+
+// The daemon is ready once the first job queue data has been written
+func (l *lifecycleTracker) markReady() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readySince == nil {
+		now := time.Now()
+		l.readySince = &now
+	}
+}
+
+func (l *lifecycleTracker) isReady() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.readySince != nil
+}
+
+func (l *lifecycleTracker) count(update func(c *LifecycleCounters)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	update(&l.counters)
+}
+
+func (l *lifecycleTracker) snapshot() DaemonStatus {
+	l.mu.Lock()
+	st := DaemonStatus{
+		Phase:      l.phase,
+		PhaseSince: l.phaseSince,
+		Ready:      l.readySince != nil,
+		ReadySince: l.readySince,
+		StartedAt:  l.startedAt,
+		Phases:     make(map[LifecyclePhase]*PhaseInfo, len(l.phases)),
+		Counters:   l.counters,
+	}
+	for phase, info := range l.phases {
+		infoCopy := *info
+		st.Phases[phase] = &infoCopy
+	}
+	l.mu.Unlock()
+
+	if serial := systemSerial.Load(); serial != nil {
+		st.SystemSerial = *serial
+	}
+	st.Tagnumber = tagnumber.Load()
+	st.HasConfig = clientConfig.Load() != nil
+	st.ConfigStale = clientConfigStale.Load()
+	st.Enrollment = enrollmentStatus.Load()
+	st.Retries = retry.Snapshot()
+	if o := outbox.Load(); o != nil {
+		st.Outbox = len(o.pending())
+	}
+	return st
+}
+
+func daemonStatusJSON() (string, error) {
+	b, err := json.Marshal(lifecycle.snapshot())
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal daemon status: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,150 @@
+//go:build linux && amd64
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field names shared by every component, so the server side and journalctl
+// filters can rely on them
+const (
+	FieldComponent       = "component"
+	FieldTagnumber       = "tagnumber"
+	FieldSerial          = "system_serial"
+	FieldKey             = "key"
+	FieldTransactionUUID = "transaction_uuid"
+	FieldLatency         = "latency_ms"
+)
+
+func Tagnumber(tag int64) slog.Attr       { return slog.Int64(FieldTagnumber, tag) }
+func Serial(serial string) slog.Attr      { return slog.String(FieldSerial, serial) }
+func Key(key string) slog.Attr            { return slog.String(FieldKey, key) }
+func TransactionUUID(id string) slog.Attr { return slog.String(FieldTransactionUUID, id) }
+func Latency(d time.Duration) slog.Attr {
+	return slog.Float64(FieldLatency, float64(d.Microseconds())/1000)
+}
+
+// Component returns the default logger tagged with a component name. Call it
+// where the logger is used, not at package init, so it picks up Setup.
+func Component(name string) *slog.Logger {
+	return slog.Default().With(FieldComponent, name)
+}
+
+// Output formats accepted by Setup
+const (
+	FormatAuto    = "auto" // journal under systemd, text otherwise
+	FormatText    = "text"
+	FormatJSON    = "json"
+	FormatJournal = "journal"
+)
+
+// ParseFormat checks a log format name
+func ParseFormat(v string) (string, error) {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case FormatAuto, FormatText, FormatJSON, FormatJournal:
+		return v, nil
+	}
+	return "", fmt.Errorf("log format must be auto, text, json or journal: '%s'", v)
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(v))); err != nil {
+		return 0, fmt.Errorf("log level must be debug, info, warn or error: '%s'", v)
+	}
+	return level, nil
+}
+
+// Setup makes a logger writing to w in format the default for slog and the
+// log package
+func Setup(w io.Writer, format string, level slog.Level) {
+	if format == FormatAuto {
+		// systemd sets this when stderr goes to the journal
+		format = FormatText
+		if os.Getenv("JOURNAL_STREAM") != "" {
+			format = FormatJournal
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	case FormatJournal:
+		h = newJournalHandler(w, opts)
+	default:
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// Writes one line per record with a <priority> prefix, which journald turns
+// into the syslog priority of the entry. Time and level are left out since
+// the journal records both.
+type journalHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	buf   *bytes.Buffer
+	inner slog.Handler // text handler writing to buf
+}
+
+func newJournalHandler(w io.Writer, opts *slog.HandlerOptions) *journalHandler {
+	buf := &bytes.Buffer{}
+	inner := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: opts.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &journalHandler{mu: &sync.Mutex{}, w: w, buf: buf, inner: inner}
+}
+
+// Priorities from sd-daemon.h
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // SD_ERR
+	case level >= slog.LevelWarn:
+		return 4 // SD_WARNING
+	case level >= slog.LevelInfo:
+		return 6 // SD_INFO
+	}
+	return 7 // SD_DEBUG
+}
+
+func (h *journalHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	fmt.Fprintf(h.buf, "<%d>", journalPriority(r.Level))
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	_, err := h.w.Write(h.buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{mu: h.mu, w: h.w, buf: h.buf, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{mu: h.mu, w: h.w, buf: h.buf, inner: h.inner.WithGroup(name)}
+}
@@ -3,13 +3,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -17,56 +16,25 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
+	"uit-clientd/config"
+	"uit-clientd/journal"
+	"uit-clientd/keypolicy"
+	"uit-clientd/logging"
 	"uit-clientd/requests"
+	"uit-clientd/retry"
 
 	"github.com/google/uuid"
 )
 
 var (
-	clientConfig atomic.Pointer[ClientConfig]
-	systemSerial atomic.Pointer[string]
-	tagnumber    atomic.Int64
-	jobQueueData atomic.Pointer[requests.ClientJobQueueDataResponse]
+	daemonSettings atomic.Pointer[config.Settings]
+	clientConfig   atomic.Pointer[ClientConfig]
+	systemSerial   atomic.Pointer[string]
+	systemIdentity atomic.Pointer[requests.SystemIdentity]
+	tagnumber      atomic.Int64
+	jobQueueData   atomic.Pointer[requests.ClientJobQueueDataResponse]
 )
 
-const unixSocketPath = "/run/uit-client/uit-clientd.sock"
-
-func GetClientConfig() (*ClientConfig, error) {
-	reqURL := &url.URL{
-		Scheme:   "https",
-		Host:     "10.0.0.1:31411",
-		Path:     "/static/client/configs/uit-client",
-		RawQuery: "json=true",
-	}
-	queries := url.Values{}
-	queries.Set("json", "true")
-	reqURL.RawQuery = queries.Encode()
-
-	httpRequestConfig := new(HTTPRequestConfig)
-	httpRequestConfig.URL = *reqURL
-	httpRequestConfig.Method = "GET"
-
-	httpRequest := &HTTPRequest{
-		Config:  httpRequestConfig,
-		Payload: nil,
-	}
-
-	jsonBody, err := sendHTTPRequest(context.Background(), httpRequest)
-	if err != nil {
-		return nil, fmt.Errorf("error in GetClientConfig: %w", err)
-	}
-	if len(jsonBody) == 0 {
-		return nil, fmt.Errorf("received nil or empty response body in GetClientConfig")
-	}
-
-	var configData ClientConfig
-	if err := json.NewDecoder(bytes.NewReader(jsonBody)).Decode(&configData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal GetClientConfig response: %w", err)
-	}
-
-	return &configData, nil
-}
-
 func handleInput(ctx context.Context, stdinData string) (string, error) {
 
 	select {
@@ -80,30 +48,61 @@ func handleInput(ctx context.Context, stdinData string) (string, error) {
 		return "", fmt.Errorf("input cannot be empty or whitespace")
 	}
 
-	// fmt.Printf("received stdin data: %s\n", clean)
-
+	start := time.Now()
 	httpRequest, err := MapInputToHTTPRequest(clean)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create array from input: %v\n", err)
+		logging.Component("socket").Warn("invalid request", "error", err)
+		entry := newJournalEntry("socket", clean, nil)
+		entry.Validation = err.Error()
+		policyRejections.Inc(metricKey(entry.Key))
+		recordRequest(entry, start, journal.OutcomeRejected, 0, err)
 		return "", err
 	}
-
-	// Bypass HTTP for some keys
-	switch httpRequest.Payload.Key {
-	case "new_transaction_uuid":
-		u, err := uuid.NewV7()
+	entry := newJournalEntry("socket", clean, httpRequest.Payload)
+	rule, _ := keypolicy.Lookup(httpRequest.Payload.Key)
+	if rule.BypassHTTP {
+		response, err := handleLocalKey(httpRequest)
+		outcome := journal.OutcomeLocal
 		if err != nil {
+			outcome = journal.OutcomeFailed
+		} else if httpRequest.Payload.Key == "new_transaction_uuid" {
+			entry.TransactionUUID = response
+		}
+		recordRequest(entry, start, outcome, 0, err)
+		return response, err
+	}
+
+	// Job stats carry the transaction UUID of the job in progress
+	if rule.RequiresUUID && httpRequest.Payload.TransactionUUID != nil {
+		setTransactionUUID(*httpRequest.Payload.TransactionUUID)
+	}
+
+	// Completion flags and the like must survive a down server or a reboot
+	if rule.Durable {
+		if o := outbox.Load(); o != nil {
+			err := o.send(ctx, httpRequest.Payload.Key, clean)
+			outcome := journal.OutcomeQueued
+			if err != nil {
+				outcome = journal.OutcomeFailed
+			}
+			recordRequest(entry, start, outcome, 0, err)
 			return "", err
 		}
-		return u.String(), nil
-	default:
 	}
 
-	res, err := sendHTTPRequest(ctx, httpRequest)
+	res, status, err := sendHTTPRequestStatus(ctx, httpRequest)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to send request: %v\n", err)
+		log := logging.Component("socket").With(payloadAttrs(httpRequest.Payload)...)
+		if ctx.Err() != nil && lifecycle.current() == PhaseStopping {
+			log.Error("shutdown: DROPPED in-flight request", "error", err)
+			recordRequest(entry, start, journal.OutcomeDropped, status, err)
+			return "", err
+		}
+		log.Error("failed to send request", "error", err)
+		recordRequest(entry, start, journal.OutcomeFailed, status, err)
 		return "", err
 	}
+	recordRequest(entry, start, journal.OutcomeSent, status, nil)
 	if len(res) == 0 {
 		return "", nil
 	}
@@ -111,15 +110,49 @@ func handleInput(ctx context.Context, stdinData string) (string, error) {
 	return string(res), nil
 }
 
-func initListener(rootCtx context.Context, wg *sync.WaitGroup) error {
+// Keys answered by uit-clientd itself, without the server
+func handleLocalKey(httpRequest *HTTPRequest) (string, error) {
+	switch httpRequest.Payload.Key {
+	case "new_transaction_uuid":
+		u, err := uuid.NewV7()
+		if err != nil {
+			return "", err
+		}
+		setTransactionUUID(u.String())
+		return u.String(), nil
+	case "enrollment_status":
+		return enrollmentStatusJSON()
+	case "status":
+		return daemonStatusJSON()
+	case "subscribe":
+		return "", fmt.Errorf("subscribe must be the first request on a connection")
+	case "usage_history":
+		return queryUsageHistory(httpRequest.Payload.StringValue)
+	case "history":
+		return queryRequestHistory(httpRequest.Payload.StringValue)
+	case "retry_stats":
+		b, err := json.Marshal(retry.Snapshot())
+		if err != nil {
+			return "", fmt.Errorf("cannot marshal retry stats: %w", err)
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("key '%s' is not handled locally", httpRequest.Payload.Key)
+}
+
+// Accepts connections until rootCtx is done. Requests on them run with reqCtx,
+// which outlives rootCtx by the shutdown timeout.
+func initListener(rootCtx context.Context, reqCtx context.Context, connWg *sync.WaitGroup) error {
 	listener, inherited, err := getUnixSocketListener()
 	if err != nil {
 		return err
 	}
+	listenerUp.Store(true)
+	notifyReadyIfDone()
 	defer func() {
 		_ = listener.Close()
 		if !inherited {
-			_ = os.Remove(unixSocketPath)
+			_ = os.Remove(daemonSettings.Load().SocketPath)
 		}
 	}()
 
@@ -132,131 +165,284 @@ func initListener(rootCtx context.Context, wg *sync.WaitGroup) error {
 		conn, err := listener.Accept()
 		if err != nil {
 			if rootCtx.Err() != nil || errors.Is(err, net.ErrClosed) {
-				fmt.Fprintf(os.Stderr, "shutting down: %v\n", rootCtx.Err())
+				logging.Component("socket").Info("listener closed, shutting down", "reason", context.Cause(rootCtx))
 				return nil // no error on regular shutdown
 			}
-			fmt.Fprintf(os.Stderr, "unix socket accept error: %v\n", err)
+			logging.Component("socket").Error("accept failed", "error", err)
 			continue // no app shutdown if error isolated to specific socket connection
 		}
 
-		wg.Go((func() {
-			if err := handleConnection(rootCtx, conn); err != nil {
-				fmt.Fprintf(os.Stderr, "(handleConnection) %v", err)
+		connWg.Go((func() {
+			if err := handleConnection(rootCtx, reqCtx, conn); err != nil {
+				logging.Component("socket").Error("connection failed", "error", err)
 			}
 		}))
 	}
 }
 
+// Runs after rootCtx is done: the listener is closed, in-flight requests get
+// until the shutdown deadline to finish, then the outbox is flushed one last time.
+func shutdown(wg *sync.WaitGroup, connWg *sync.WaitGroup, reqCtx context.Context, timeout time.Duration) {
+	log := logging.Component("shutdown")
+	lifecycle.setPhase(PhaseStopping)
+	wg.Wait()
+	log.Info("listener closed, waiting for in-flight requests", "timeout", timeout.String())
+	connWg.Wait()
+
+	o := outbox.Load()
+	if o == nil {
+		return
+	}
+	if len(o.pending()) > 0 {
+		log.Info("flushing queued requests", "count", len(o.pending()))
+		if err := o.flush(reqCtx); err != nil {
+			log.Error("outbox flush failed", "error", err)
+		}
+	}
+	for _, entry := range o.pending() {
+		log.Warn("queued request not sent, kept for the next start",
+			logging.Key(entry.Key), "queued_at", entry.QueuedAt.Format(time.RFC3339), "path", o.path)
+	}
+}
+
 func main() {
+	// SIGHUP reloads the client config instead of stopping the daemon
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
 	rootCtx, rootCtxCancel := signal.NotifyContext(
 		context.Background(),
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGQUIT,
 		syscall.SIGABRT,
 		syscall.SIGTERM,
 	)
 	defer rootCtxCancel()
+	context.AfterFunc(rootCtx, func() { lifecycle.setPhase(PhaseStopping) })
 
-	config, err := GetClientConfig()
+	settings, err := config.Load(os.Args[1:])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to get client config: %v\n", err)
+		slog.Error("failed to load settings", "error", err)
 		return
 	}
-	if config == nil || strings.TrimSpace(config.UIT_WEB_HTTPS_HOST) == "" || strings.TrimSpace(config.UIT_WEB_HTTPS_PORT) == "" {
-		fmt.Fprintf(os.Stderr, "client config is invalid\n")
-		return
+	logging.Setup(os.Stderr, settings.LogFormat, settings.LogLevel)
+	daemonSettings.Store(settings)
+	applyServerEndpoint()
+	log := logging.Component("main")
+	log.Info("server URL", "url", settings.ServerURL.String(), "source", settings.Sources["server_url"])
+
+	// Requests from the socket outlive rootCtx by the shutdown timeout
+	reqCtx, reqCtxCancel := context.WithCancel(context.WithoutCancel(rootCtx))
+	defer reqCtxCancel()
+	context.AfterFunc(rootCtx, func() { time.AfterFunc(settings.ShutdownTimeout, reqCtxCancel) })
+
+	loadTransactionUUID()
+	if err := requests.InitAppStatus(settings.StateDir); err != nil {
+		log.Error("failed to load app status", "error", err)
+	}
+	queued, err := loadOutbox(outboxPath())
+	if err != nil {
+		log.Error("failed to load outbox", "error", err)
+	}
+	outbox.Store(queued)
+	if j, err := journal.Open(requestJournalPath(), settings.JournalMaxBytes, requestJournalBackups); err != nil {
+		log.Error("failed to open request journal, requests are not recorded", "error", err)
+	} else {
+		requestJournal.Store(j)
+		defer j.Close()
+	}
+	if n := len(queued.pending()); n > 0 {
+		logging.Component("outbox").Info("requests queued from a previous run", "count", n)
 	}
-	clientConfig.Store(config)
 
-	var wg sync.WaitGroup
+	initUsageHistory(settings.UsageSampleInterval, settings.UsageHistoryDuration)
 
-	// System serial, set once
-	for {
-		if rootCtx.Err() != nil {
-			fmt.Fprintf(os.Stdout, "(main - system serial loop): %v\n", rootCtx.Err())
-			return
-		}
-		if systemSerial.Load() != nil && *systemSerial.Load() != "" {
-			break
-		}
-		s, err := requests.GetSerial(rootCtx)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to retrieve system serial, retrying: %v\n", err)
-			continue
+	var wg, connWg sync.WaitGroup
+
+	// Unix socket listener, up before anything that needs the server
+	// so local-only keys are served even when the server is down
+	wg.Go(func() {
+		if err := initListener(rootCtx, reqCtx, &connWg); err != nil {
+			logging.Component("socket").Error("failed to acquire unix socket listener", "error", err)
 		}
-		systemSerial.Store(&s)
-		time.Sleep(1 * time.Second)
+	})
+
+	// Self-metrics for scraping, off unless an address is set
+	if settings.MetricsListen != "" {
+		wg.Go(func() {
+			if err := runMetricsServer(rootCtx, settings.MetricsListen); err != nil {
+				logging.Component("metrics").Error("metrics server stopped", "error", err)
+			}
+		})
 	}
 
-	// Tag number, set once
-	for {
-		if rootCtx.Err() != nil {
-			fmt.Fprintf(os.Stdout, "(main - tag num loop): %v\n", rootCtx.Err())
-			return
-		}
-		if tagnumber.Load() > 100000 && tagnumber.Load() < 999999 {
-			break
-		}
-		tag, err := requests.GetTagFromSerial(rootCtx, *systemSerial.Load())
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to retrieve tag number, retrying: %v\n", err)
-			continue
-		}
-		tagnumber.Store(tag)
-		time.Sleep(1 * time.Second)
+	// CPU and network usage history, local only
+	wg.Go(func() {
+		runUsageSampler(rootCtx, settings.UsageSampleInterval)
+	})
+
+	lifecycle.setPhase(PhaseWaitingConfig)
+	initClientConfig(rootCtx)
+
+	// Queued durable requests, replayed from the previous run first
+	wg.Go(func() {
+		queued.run(rootCtx)
+	})
+
+	// Client config reloads, and retries while the config is stale or missing
+	wg.Go(func() {
+		clientConfigReloadLoop(rootCtx, hupChan, settings.ConfigRefreshInterval)
+	})
+
+	// System identity, set once. DMI and sysfs may not be ready this early
+	// during boot, so finding no identity is retried.
+	lifecycle.setPhase(PhaseWaitingSerial)
+	var id requests.SystemIdentity
+	err = retry.Do(rootCtx, retry.Policy{
+		Name:            "identity",
+		InitialInterval: time.Second,
+		MaxInterval:     30 * time.Second,
+		Classify:        func(err error) bool { return errors.Is(err, requests.ErrNoIdentity) },
+	}, func(ctx context.Context) error {
+		var err error
+		id, err = requests.ResolveIdentity(ctx)
+		lifecycle.recordError(PhaseWaitingSerial, err)
+		return err
+	})
+	if err != nil {
+		log.Error("no system identity", "error", err)
+		shutdown(&wg, &connWg, reqCtx, settings.ShutdownTimeout)
+		return
+	}
+	if id.Weak() {
+		log.Warn("weak system identity", "source", id.Source, logging.Serial(id.Serial))
+	} else {
+		log.Info("system identity", "source", id.Source, logging.Serial(id.Serial))
 	}
+	systemIdentity.Store(&id)
+	systemSerial.Store(&id.Serial)
 
-	// Unix socket listener
+	// Tag number, set once by enrollment. Until then the client is keyed by
+	// serial.
+	lifecycle.setPhase(PhaseWaitingTag)
 	wg.Go(func() {
-		if err := initListener(rootCtx, &wg); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to acquire unix socket listener: %v\n", err)
-		}
+		runEnrollment(rootCtx, *systemIdentity.Load())
+	})
+
+	// Live telemetry, hardware and job state sent as one document
+	wg.Go(func() {
+		runTelemetryReporter(rootCtx, settings.TelemetryInterval, settings.MetricsUploadInterval)
+	})
+	wg.Go(func() {
+		runLastHeardReporter(rootCtx, settings.TelemetryInterval)
+	})
+
+	// Disk temperature, per key
+	wg.Go(func() {
+		runHardwareReporter(rootCtx, settings.HardwareReportInterval)
 	})
 
+	// Live screenshots from the framebuffer
+	wg.Go(func() {
+		runScreenshotLoop(rootCtx, settings.FramebufferDevice, settings.ScreenshotIntervals)
+	})
+
+	// Text of the virtual console, a lighter live view than screenshots
+	if settings.ConsoleDevice != "" {
+		wg.Go(func() {
+			runConsoleLoop(rootCtx, settings.ConsoleDevice, settings.ConsoleFormat, settings.ScreenshotIntervals)
+		})
+	}
+
 	// Main app loop
 	wg.Go(func() {
-		timer := time.NewTimer(3 * time.Second)
+		pollInterval := settings.JobPollInterval
+		jobState := newJobStatePublisher(settings.JobQueueDataPath)
+		timer := time.NewTimer(pollInterval)
 		defer timer.Stop()
 
 		mainLoop := func() error {
 			if rootCtx.Err() != nil {
-				return fmt.Errorf("(main - app loop): %v\n", rootCtx.Err())
+				return rootCtx.Err()
 			}
-			jqd, err := requests.GetJobQueueData(rootCtx, tagnumber.Load())
+			jqd, err := requests.GetJobQueueData(rootCtx, tagnumber.Load(), *systemSerial.Load())
 			if err != nil {
-				return fmt.Errorf("error retrieving client job queue data: %v\n", err)
+				return fmt.Errorf("error retrieving client job queue data: %w", err)
 			}
-			jobQueueData.Store(&jqd)
+			prev := jobQueueData.Swap(&jqd)
 
-			jobQueueBytes, err := json.Marshal(jobQueueData.Load())
+			seq, changed, err := jobState.publish(jqd)
 			if err != nil {
-				return fmt.Errorf("cannot unmarshal ClientJobQueueDataResponse JSON (main): %v\n", err)
+				return err
 			}
-			if err := os.WriteFile("/root/job_queue_data", jobQueueBytes, 0644); err != nil {
-				return fmt.Errorf("error writing client job queue data to disk: %v\n", err)
+			if changed {
+				publishJobEvents(prev, jqd, seq)
+				if isNewCancel(prev, &jqd) {
+					handleJobCancelled()
+				} else if isNewQueueConflict(prev, &jqd) {
+					handleQueueConflict()
+				}
+			} else if !jobEvents.hasState() {
+				jobEvents.publish(JobEvent{Type: JobEventSnapshot, Sequence: seq, Time: time.Now(), Job: &jqd})
 			}
 			return nil
 		}
 
+		// Failed polls back off from the poll interval, the first success resets it
+		backoff := retry.Policy{
+			Name:            "job_poll",
+			InitialInterval: pollInterval,
+			MaxInterval:     max(pollInterval, time.Minute),
+		}.NewBackoff()
+
+		// Watchdog pings come from this loop, so a hung poll stops them
+		var watchdog <-chan time.Time
+		if interval, ok := sdWatchdogInterval(); ok {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			watchdog = ticker.C
+			_ = sdNotify("WATCHDOG=1")
+		}
+
 		for {
-			timer.Reset(3 * time.Second)
 			select {
 			case <-rootCtx.Done():
-				fmt.Fprintf(os.Stdout, "(main - app loop case stmt): %v\n", rootCtx.Err())
+				logging.Component("job_poll").Info("stopped", "reason", context.Cause(rootCtx))
 				return
+			case <-watchdog:
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					logging.Component("systemd").Error("sd_notify failed", "error", err)
+				}
 			case <-timer.C:
 				if err := mainLoop(); err != nil {
-					fmt.Fprintf(os.Stdout, "error in main/mainLoop(), continuing: %v", err)
+					lifecycle.count(func(c *LifecycleCounters) { c.JobPollFailures++ })
+					if phase := lifecycle.current(); phase == PhasePolling || phase == PhaseDegraded {
+						lifecycle.setPhase(PhaseDegraded)
+						lifecycle.recordError(PhaseDegraded, err)
+					} else {
+						lifecycle.recordError(PhaseWaitingTag, err)
+					}
+					timer.Reset(backoff.Delay(err))
+					continue
+				}
+				backoff.Success()
+				lifecycle.count(func(c *LifecycleCounters) { c.JobPolls++ })
+				lifecycle.markReady()
+				// Polling by serial still counts as waiting for the tag
+				if tagnumber.Load() != 0 {
+					lifecycle.setPhase(PhasePolling)
 				}
+				notifyReadyIfDone()
+				timer.Reset(pollInterval)
 			}
 		}
 	})
 
-	wg.Wait()
+	shutdown(&wg, &connWg, reqCtx, settings.ShutdownTimeout)
 
 	if rootCtx.Err() != nil {
-		fmt.Fprintf(os.Stdout, "uit-clientd shutdown due to context: %v", rootCtx.Err())
+		log.Info("uit-clientd stopped", "reason", context.Cause(rootCtx))
 		return
 	}
 }
@@ -0,0 +1,151 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"uit-clientd/keypolicy"
+	"uit-clientd/logging"
+	"uit-clientd/metrics"
+	"uit-clientd/retry"
+)
+
+var (
+	socketConnections = metrics.NewCounter("uit_clientd_socket_connections_total",
+		"Connections accepted on the unix socket")
+	socketConnectionsActive = metrics.NewGauge("uit_clientd_socket_connections_active",
+		"Connections open on the unix socket, including event subscribers")
+	requestsHandled = metrics.NewCounter("uit_clientd_requests_total",
+		"Requests by source (socket or outbox), key and outcome", "source", "key", "outcome")
+	requestLatency = metrics.NewHistogram("uit_clientd_request_duration_seconds",
+		"Time to handle a request, from the socket line to the response", nil, "key")
+	policyRejections = metrics.NewCounter("uit_clientd_policy_rejections_total",
+		"Socket requests that failed key policy validation", "key")
+)
+
+// Keys outside the policy come from arbitrary input, they share one label
+// value so they cannot grow the number of series
+func metricKey(key string) string {
+	if _, ok := keypolicy.Lookup(key); ok {
+		return key
+	}
+	return "unknown"
+}
+
+func lifecycleCounter(name string, help string, value func(c LifecycleCounters) int64) {
+	metrics.NewCollector(name, help, metrics.TypeCounter, func() []metrics.Sample {
+		lifecycle.mu.Lock()
+		defer lifecycle.mu.Unlock()
+		return []metrics.Sample{{Value: float64(value(lifecycle.counters))}}
+	})
+}
+
+func retryCounter(name string, help string, value func(s retry.Stats) int64) {
+	metrics.NewCollector(name, help, metrics.TypeCounter, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for policy, stats := range retry.Snapshot() {
+			samples = append(samples, metrics.Sample{
+				Labels: []metrics.Label{{Name: "policy", Value: policy}},
+				Value:  float64(value(stats)),
+			})
+		}
+		return samples
+	})
+}
+
+// State that is already tracked elsewhere is read when the metrics are written
+func init() {
+	lifecycleCounter("uit_clientd_job_polls_total", "Successful job queue polls",
+		func(c LifecycleCounters) int64 { return c.JobPolls })
+	lifecycleCounter("uit_clientd_job_poll_failures_total", "Failed job queue polls",
+		func(c LifecycleCounters) int64 { return c.JobPollFailures })
+	lifecycleCounter("uit_clientd_config_reload_failures_total", "Failed client config reloads",
+		func(c LifecycleCounters) int64 { return c.ConfigReloadFailures })
+	lifecycleCounter("uit_clientd_telemetry_failures_total", "Live data reports the server did not accept",
+		func(c LifecycleCounters) int64 { return c.TelemetryFailures })
+	lifecycleCounter("uit_clientd_screenshots_sent_total", "Live screenshots uploaded",
+		func(c LifecycleCounters) int64 { return c.ScreenshotsSent })
+
+	retryCounter("uit_clientd_retry_attempts_total", "Attempts made under each retry policy",
+		func(s retry.Stats) int64 { return s.Attempts })
+	retryCounter("uit_clientd_retry_retries_total", "Failed attempts that were retried",
+		func(s retry.Stats) int64 { return s.Retries })
+	retryCounter("uit_clientd_retry_give_ups_total", "Operations given up on after their last attempt",
+		func(s retry.Stats) int64 { return s.GiveUps })
+
+	metrics.NewGaugeFunc("uit_clientd_goroutines", "Number of goroutines",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	metrics.NewGaugeFunc("uit_clientd_outbox_pending", "Durable requests waiting in the outbox",
+		func() float64 {
+			if o := outbox.Load(); o != nil {
+				return float64(len(o.pending()))
+			}
+			return 0
+		})
+	metrics.NewGaugeFunc("uit_clientd_uptime_seconds", "Time since uit-clientd started",
+		func() float64 {
+			lifecycle.mu.Lock()
+			defer lifecycle.mu.Unlock()
+			return time.Since(lifecycle.startedAt).Seconds()
+		})
+	metrics.NewGaugeFunc("uit_clientd_ready", "1 once the first job queue data has been written",
+		func() float64 {
+			if lifecycle.isReady() {
+				return 1
+			}
+			return 0
+		})
+	metrics.NewCollector("uit_clientd_phase", "Lifecycle phase, 1 for the current one", metrics.TypeGauge,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Labels: []metrics.Label{{Name: "phase", Value: string(lifecycle.current())}}, Value: 1}}
+		})
+}
+
+// Serves /metrics on address until ctx is done. An address starting with /
+// is a unix socket, anything else a loopback host:port.
+func runMetricsServer(ctx context.Context, address string) error {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+		// Left behind by a crash, a regular file is not ours to remove
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("cannot listen on '%s': %w", address, err)
+	}
+	if network == "unix" {
+		defer os.Remove(address)
+		if err := os.Chmod(address, 0660); err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to chmod metrics socket: %w", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+	stop := context.AfterFunc(ctx, func() { _ = server.Close() })
+	defer stop()
+
+	logging.Component("metrics").Info("serving metrics", "network", network, "address", address)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("metrics server failed: %w", err)
+	}
+	return nil
+}
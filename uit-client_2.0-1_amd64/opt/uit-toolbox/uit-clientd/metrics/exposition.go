@@ -0,0 +1,160 @@
+//go:build linux && amd64
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType of WriteText output
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeLabels(w *bufio.Writer, labels []Label, extra ...Label) {
+	if len(labels)+len(extra) == 0 {
+		return
+	}
+	w.WriteByte('{')
+	for i, l := range append(labels[:len(labels):len(labels)], extra...) {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(l.Name)
+		w.WriteString(`="`)
+		labelEscaper.WriteString(w, l.Value)
+		w.WriteByte('"')
+	}
+	w.WriteByte('}')
+}
+
+func writeSample(w *bufio.Writer, name string, labels []Label, value string, extra ...Label) {
+	w.WriteString(name)
+	writeLabels(w, labels, extra...)
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+// WriteText writes every registered metric in the Prometheus text exposition
+// format. Families without samples are left out.
+func WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range registered() {
+		samples := sortedSamples(f)
+		if len(samples) == 0 {
+			continue
+		}
+		bw.WriteString("# HELP " + f.name() + " ")
+		helpEscaper.WriteString(bw, f.help())
+		bw.WriteString("\n# TYPE " + f.name() + " " + f.kind() + "\n")
+		for _, s := range samples {
+			if s.histogram == nil {
+				writeSample(bw, f.name(), s.labels, formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, count := range s.histogram.counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(s.histogram.bounds) {
+					le = formatFloat(s.histogram.bounds[i])
+				}
+				writeSample(bw, f.name()+"_bucket", s.labels, strconv.FormatUint(cumulative, 10), Label{Name: "le", Value: le})
+			}
+			writeSample(bw, f.name()+"_sum", s.labels, formatFloat(s.histogram.sum))
+			writeSample(bw, f.name()+"_count", s.labels, strconv.FormatUint(s.histogram.count, 10))
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler serves WriteText over HTTP
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		if r.Method == http.MethodHead {
+			return
+		}
+		_ = WriteText(w)
+	})
+}
+
+// Family is a metric family in Snapshot
+type Family struct {
+	Name    string           `json:"name"`
+	Type    string           `json:"type"`
+	Samples []SnapshotSample `json:"samples"`
+}
+
+// SnapshotSample is one series. For histograms, Value is the number of
+// observations and the buckets are cumulative, keyed by upper bound.
+type SnapshotSample struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   float64           `json:"value"`
+	Sum     float64           `json:"sum,omitzero"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+}
+
+// Snapshot returns every registered metric with samples, for sending as JSON
+func Snapshot() []Family {
+	var out []Family
+	for _, f := range registered() {
+		samples := sortedSamples(f)
+		if len(samples) == 0 {
+			continue
+		}
+		family := Family{Name: f.name(), Type: f.kind(), Samples: make([]SnapshotSample, 0, len(samples))}
+		for _, s := range samples {
+			snap := SnapshotSample{Value: s.value}
+			if len(s.labels) > 0 {
+				snap.Labels = make(map[string]string, len(s.labels))
+				for _, l := range s.labels {
+					snap.Labels[l.Name] = l.Value
+				}
+			}
+			if h := s.histogram; h != nil {
+				snap.Value = float64(h.count)
+				snap.Sum = h.sum
+				snap.Buckets = make(map[string]uint64, len(h.counts))
+				var cumulative uint64
+				for i, count := range h.counts {
+					cumulative += count
+					le := "+Inf"
+					if i < len(h.bounds) {
+						le = formatFloat(h.bounds[i])
+					}
+					snap.Buckets[le] = cumulative
+				}
+			}
+			family.Samples = append(family.Samples, snap)
+		}
+		out = append(out, family)
+	}
+	return out
+}
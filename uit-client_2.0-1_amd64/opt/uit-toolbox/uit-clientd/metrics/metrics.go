@@ -0,0 +1,291 @@
+//go:build linux && amd64
+
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Types of a metric family, as written in the # TYPE line
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultBuckets are upper bounds in seconds, for request latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Label is one label of a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one value of a family, as returned by collector functions
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+type family interface {
+	name() string
+	help() string
+	kind() string
+	samples() []sample
+}
+
+// A sample of any type, histograms carry their buckets
+type sample struct {
+	labels    []Label
+	value     float64
+	histogram *histogramData
+}
+
+type histogramData struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative, last one is +Inf
+	count  uint64
+	sum    float64
+}
+
+var (
+	registryMu sync.Mutex
+	families   []family
+	names      = make(map[string]bool)
+)
+
+// Metrics are registered once at package init, a name used twice is a bug
+func register(f family) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if names[f.name()] {
+		panic(fmt.Sprintf("metrics: '%s' registered twice", f.name()))
+	}
+	names[f.name()] = true
+	families = append(families, f)
+}
+
+func registered() []family {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return slices.Clone(families)
+}
+
+type desc struct {
+	fname  string
+	fhelp  string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fname }
+func (d *desc) help() string { return d.fhelp }
+
+func (d *desc) labelPairs(values []string) []Label {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: '%s' takes %d label values, got %d", d.fname, len(d.labels), len(values)))
+	}
+	pairs := make([]Label, len(values))
+	for i, v := range values {
+		pairs[i] = Label{Name: d.labels[i], Value: v}
+	}
+	return pairs
+}
+
+// Series of a family are keyed by their label values
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Counter only goes up. Label values are passed in the order of the label
+// names given to NewCounter.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+// NewCounter registers a counter
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{fname: name, fhelp: help, labels: labels}, values: make(map[string]*sample)}
+	register(c)
+	return c
+}
+
+func (c *Counter) kind() string { return TypeCounter }
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	key := seriesKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labels: c.labelPairs(labelValues)}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *Counter) samples() []sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]sample, 0, len(c.values))
+	for _, s := range c.values {
+		out = append(out, *s)
+	}
+	return out
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	Counter
+}
+
+// NewGauge registers a gauge
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{Counter{desc: desc{fname: name, fhelp: help, labels: labels}, values: make(map[string]*sample)}}
+	register(g)
+	return g
+}
+
+func (g *Gauge) kind() string { return TypeGauge }
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.values[key]
+	if !ok {
+		s = &sample{labels: g.labelPairs(labelValues)}
+		g.values[key] = s
+	}
+	s.value = v
+}
+
+// Add adds v, which may be negative
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.values[key]
+	if !ok {
+		s = &sample{labels: g.labelPairs(labelValues)}
+		g.values[key] = s
+	}
+	s.value += v
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	desc
+	bounds []float64
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+// NewHistogram registers a histogram. buckets are upper bounds in increasing
+// order, nil means DefaultBuckets.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of '%s' are not sorted", name))
+	}
+	h := &Histogram{desc: desc{fname: name, fhelp: help, labels: labels}, bounds: buckets, values: make(map[string]*sample)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) kind() string { return TypeHistogram }
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &sample{
+			labels:    h.labelPairs(labelValues),
+			histogram: &histogramData{bounds: h.bounds, counts: make([]uint64, len(h.bounds)+1)},
+		}
+		h.values[key] = s
+	}
+	i, _ := slices.BinarySearch(h.bounds, v) // first bound >= v
+	s.histogram.counts[i]++
+	s.histogram.count++
+	s.histogram.sum += v
+}
+
+func (h *Histogram) samples() []sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]sample, 0, len(h.values))
+	for _, s := range h.values {
+		data := *s.histogram
+		data.counts = slices.Clone(data.counts)
+		out = append(out, sample{labels: s.labels, histogram: &data})
+	}
+	return out
+}
+
+// Values read when the metrics are collected, for state that is already
+// kept elsewhere
+type collector struct {
+	desc
+	typ     string
+	collect func() []Sample
+}
+
+// NewCollector registers a counter or gauge family whose samples come from
+// collect every time the metrics are written
+func NewCollector(name string, help string, typ string, collect func() []Sample) {
+	register(&collector{desc: desc{fname: name, fhelp: help}, typ: typ, collect: collect})
+}
+
+// NewGaugeFunc registers a gauge without labels read from value
+func NewGaugeFunc(name string, help string, value func() float64) {
+	NewCollector(name, help, TypeGauge, func() []Sample {
+		return []Sample{{Value: value()}}
+	})
+}
+
+func (c *collector) kind() string { return c.typ }
+
+func (c *collector) samples() []sample {
+	collected := c.collect()
+	out := make([]sample, len(collected))
+	for i, s := range collected {
+		out[i] = sample{labels: s.Labels, value: s.Value}
+	}
+	return out
+}
+
+// Samples of a family in a stable order, by label values
+func sortedSamples(f family) []sample {
+	samples := f.samples()
+	slices.SortFunc(samples, func(a, b sample) int {
+		for i := range min(len(a.labels), len(b.labels)) {
+			if c := strings.Compare(a.labels[i].Value, b.labels[i].Value); c != 0 {
+				return c
+			}
+		}
+		return len(a.labels) - len(b.labels)
+	})
+	return samples
+}
@@ -0,0 +1,221 @@
+//go:build linux && amd64
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The registry is shared by the whole test binary and a name can only be
+// registered once, even with -count, so test metrics are registered here.
+// Tests clear the series they use and only look at the lines of their own
+// families.
+var (
+	testRequests    = NewCounter("test_requests_total", "Requests by key\nand outcome", "key", "outcome")
+	testConnections = NewGauge("test_connections", "Open connections")
+	testEscaped     = NewCounter("test_escaped_total", `Help with a \ backslash`, "path")
+	testLatency     = NewHistogram("test_latency_seconds", "Latency", []float64{0.1, 1}, "method")
+	testSnapshot    = NewHistogram("test_snapshot_seconds", "Snapshot", []float64{1}, "key")
+	testHandler     = NewGauge("test_handler", "Handler")
+	testDuplicate   = NewGauge("test_duplicate", "First")
+	testUptime      float64
+)
+
+func init() {
+	NewGaugeFunc("test_uptime_seconds", "Uptime", func() float64 { return testUptime })
+	NewCollector("test_phase", "Phase", TypeGauge, func() []Sample {
+		return []Sample{{Labels: []Label{{Name: "phase", Value: "running"}}, Value: 1}}
+	})
+	NewCollector("test_empty_total", "Never has samples", TypeCounter, func() []Sample { return nil })
+}
+
+func familyText(t *testing.T, name string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteText(&buf); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	var b strings.Builder
+	for line := range strings.SplitSeq(buf.String(), "\n") {
+		metric, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE "), " ")
+		metric, _, _ = strings.Cut(metric, "{")
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			metric = strings.TrimSuffix(metric, suffix)
+		}
+		if metric == name {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+func TestCounterText(t *testing.T) {
+	c := testRequests
+	clear(c.values)
+	c.Inc("b", "sent")
+	c.Add(2.5, "a", "failed")
+	c.Inc("a", "sent")
+	c.Inc("b", "sent")
+	c.Add(-1, "b", "sent") // ignored, counters only go up
+
+	want := `# HELP test_requests_total Requests by key\nand outcome
+# TYPE test_requests_total counter
+test_requests_total{key="a",outcome="failed"} 2.5
+test_requests_total{key="a",outcome="sent"} 1
+test_requests_total{key="b",outcome="sent"} 2
+`
+	if got := familyText(t, "test_requests_total"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGaugeText(t *testing.T) {
+	g := testConnections
+	clear(g.values)
+	g.Add(3)
+	g.Dec()
+	want := "# HELP test_connections Open connections\n# TYPE test_connections gauge\ntest_connections 2\n"
+	if got := familyText(t, "test_connections"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	g.Set(-0.25)
+	if got := familyText(t, "test_connections"); !strings.HasSuffix(got, "test_connections -0.25\n") {
+		t.Errorf("after Set got\n%s", got)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	c := testEscaped
+	clear(c.values)
+	c.Inc("C:\\dir\n\"quoted\"")
+	want := `# HELP test_escaped_total Help with a \\ backslash
+# TYPE test_escaped_total counter
+test_escaped_total{path="C:\\dir\n\"quoted\""} 1
+`
+	if got := familyText(t, "test_escaped_total"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramText(t *testing.T) {
+	h := testLatency
+	clear(h.values)
+	h.Observe(0.05, "GET")
+	h.Observe(0.1, "GET") // bounds are inclusive
+	h.Observe(0.5, "GET")
+	h.Observe(7, "GET")
+
+	want := `# HELP test_latency_seconds Latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{method="GET",le="0.1"} 2
+test_latency_seconds_bucket{method="GET",le="1"} 3
+test_latency_seconds_bucket{method="GET",le="+Inf"} 4
+test_latency_seconds_sum{method="GET"} 7.65
+test_latency_seconds_count{method="GET"} 4
+`
+	if got := familyText(t, "test_latency_seconds"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCollectorText(t *testing.T) {
+	testUptime = math.Inf(1)
+	if got, want := familyText(t, "test_uptime_seconds"), "# HELP test_uptime_seconds Uptime\n# TYPE test_uptime_seconds gauge\ntest_uptime_seconds +Inf\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := familyText(t, "test_phase"); !strings.HasSuffix(got, "test_phase{phase=\"running\"} 1\n") {
+		t.Errorf("got\n%s", got)
+	}
+	// Families without samples are left out entirely
+	if got := familyText(t, "test_empty_total"); got != "" {
+		t.Errorf("got\n%s\nwant nothing", got)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{42, "42"},
+		{0.005, "0.005"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, tt := range tests {
+		if got := formatFloat(tt.v); got != tt.want {
+			t.Errorf("formatFloat(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	h := testSnapshot
+	clear(h.values)
+	h.Observe(0.5, "a")
+	h.Observe(2, "a")
+
+	var family *Family
+	for _, f := range Snapshot() {
+		if f.Name == "test_snapshot_seconds" {
+			family = &f
+		}
+	}
+	if family == nil {
+		t.Fatal("family missing from Snapshot")
+	}
+	got, err := json.Marshal(family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"test_snapshot_seconds","type":"histogram","samples":[{"labels":{"key":"a"},"value":2,"sum":2.5,"buckets":{"+Inf":2,"1":1}}]}`
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	testDuplicate.Set(1)
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	NewCounter("test_duplicate", "Second")
+}
+
+func TestHandler(t *testing.T) {
+	testHandler.Set(1)
+	tests := []struct {
+		method string
+		status int
+		body   bool
+	}{
+		{http.MethodGet, http.StatusOK, true},
+		{http.MethodHead, http.StatusOK, false},
+		{http.MethodPost, http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, "/metrics", nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.method, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && rec.Header().Get("Content-Type") != ContentType {
+			t.Errorf("%s: Content-Type %q", tt.method, rec.Header().Get("Content-Type"))
+		}
+		if got := strings.Contains(rec.Body.String(), "test_handler 1\n"); got != tt.body {
+			t.Errorf("%s: metrics in body = %v, want %v", tt.method, got, tt.body)
+		}
+	}
+}
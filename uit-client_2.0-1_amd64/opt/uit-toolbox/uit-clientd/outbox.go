@@ -0,0 +1,230 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"uit-clientd/journal"
+	"uit-clientd/logging"
+	"uit-clientd/retry"
+
+	"github.com/google/uuid"
+)
+
+const outboxFile = "outbox.jsonl"
+
+// Durable requests (see keypolicy.Policy.Durable) go through the outbox.
+// They are written to disk before they are sent and only removed once the
+// server has accepted them, so a reboot or a down server cannot lose them.
+type outboxEntry struct {
+	ID       string    `json:"id"`
+	Key      string    `json:"key"`
+	QueuedAt time.Time `json:"queued_at"`
+	Input    string    `json:"input"` // the original socket line, replayed through handleInput's path
+}
+
+type requestOutbox struct {
+	mu      sync.Mutex
+	path    string
+	entries []outboxEntry
+	// Only one flush at a time, so entries are sent in order and never twice
+	flushMu sync.Mutex
+	wake    chan struct{}
+}
+
+// Time a durable request gets to go out before the socket caller is answered
+const outboxInlineSendTimeout = 5 * time.Second
+
+var outbox atomic.Pointer[requestOutbox]
+
+func outboxPath() string {
+	return filepath.Join(daemonSettings.Load().StateDir, outboxFile)
+}
+
+// Loads queued entries left over from a previous run
+func loadOutbox(path string) (*requestOutbox, error) {
+	o := &requestOutbox{path: path, wake: make(chan struct{}, 1)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return o, fmt.Errorf("cannot read outbox '%s': %w", path, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Input == "" {
+			logging.Component("outbox").Warn("skipping invalid line", "path", path, "line", string(line))
+			continue
+		}
+		o.entries = append(o.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return o, fmt.Errorf("cannot parse outbox '%s': %w", path, err)
+	}
+	return o, nil
+}
+
+// Called with o.mu held
+func (o *requestOutbox) save() error {
+	var buf bytes.Buffer
+	for _, entry := range o.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("cannot marshal outbox entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(o.path, buf.Bytes(), 0600)
+}
+
+func (o *requestOutbox) add(key string, input string) error {
+	u, err := uuid.NewV7()
+	if err != nil {
+		return fmt.Errorf("cannot create outbox entry ID: %w", err)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = append(o.entries, outboxEntry{ID: u.String(), Key: key, QueuedAt: time.Now(), Input: input})
+	if err := o.save(); err != nil {
+		o.entries = o.entries[:len(o.entries)-1]
+		return err
+	}
+	return nil
+}
+
+func (o *requestOutbox) remove(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, entry := range o.entries {
+		if entry.ID == id {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			break
+		}
+	}
+	if err := o.save(); err != nil {
+		logging.Component("outbox").Error("failed to save after sending", "id", id, "error", err)
+	}
+}
+
+func (o *requestOutbox) pending() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]outboxEntry(nil), o.entries...)
+}
+
+// Sends queued entries in order. Stops at the first retryable failure and
+// returns it. Entries the server rejects for good are dropped and logged.
+func (o *requestOutbox) flush(ctx context.Context) error {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+	return o.flushLocked(ctx)
+}
+
+func (o *requestOutbox) flushLocked(ctx context.Context) error {
+	for _, entry := range o.pending() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		start := time.Now()
+		status := 0
+		httpRequest, err := MapInputToHTTPRequest(entry.Input)
+		if err == nil {
+			_, status, err = sendHTTPRequestStatus(ctx, httpRequest)
+		}
+		journalEntry := newJournalEntry("outbox", entry.Input, nil)
+		if err == nil {
+			o.remove(entry.ID)
+			recordRequest(journalEntry, start, journal.OutcomeSent, status, nil)
+			logging.Component("outbox").Info("sent", logging.Key(entry.Key), "queued_at", entry.QueuedAt.Format(time.RFC3339))
+			continue
+		}
+		if ctx.Err() == nil && !retry.IsRetryable(err) {
+			o.remove(entry.ID)
+			recordRequest(journalEntry, start, journal.OutcomeDropped, status, err)
+			logging.Component("outbox").Error("DROPPED, server will not accept it",
+				logging.Key(entry.Key), "queued_at", entry.QueuedAt.Format(time.RFC3339), "error", err)
+			continue
+		}
+		recordRequest(journalEntry, start, journal.OutcomeFailed, status, err)
+		return fmt.Errorf("outbox: cannot send %s, %d request(s) still queued: %w", entry.Key, len(o.pending()), err)
+	}
+	return nil
+}
+
+// Queues a durable request and tries to send it right away. A failed send
+// is not an error for the caller, the request stays queued.
+func (o *requestOutbox) send(ctx context.Context, key string, input string) error {
+	if err := o.add(key, input); err != nil {
+		return fmt.Errorf("cannot queue %s: %w", key, err)
+	}
+	// A flush already running sends it on its next pass
+	if !o.flushMu.TryLock() {
+		o.notify()
+		return nil
+	}
+	defer o.flushMu.Unlock()
+	sendCtx, cancel := context.WithTimeout(ctx, outboxInlineSendTimeout)
+	defer cancel()
+	if err := o.flushLocked(sendCtx); err != nil {
+		logging.Component("outbox").Warn("send failed, retrying in the background", logging.Key(key), "error", err)
+		o.notify()
+	}
+	return nil
+}
+
+func (o *requestOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Retries queued entries in the background until ctx is done
+func (o *requestOutbox) run(ctx context.Context) {
+	backoff := retry.Policy{
+		Name:            "outbox",
+		InitialInterval: 5 * time.Second,
+		MaxInterval:     2 * time.Minute,
+	}.NewBackoff()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+		if len(o.pending()) == 0 {
+			continue
+		}
+		if err := o.flush(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			timer.Reset(backoff.Delay(err))
+			continue
+		}
+		backoff.Success()
+	}
+}
@@ -0,0 +1,214 @@
+//go:build linux && amd64
+
+package pngstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Defined in libpng/png.c: static const png_byte png_signature[8] = {137, 80, 78, 71, 13, 10, 26, 10};
+var Signature = []byte{137, 80, 78, 71, 13, 10, 26, 10}
+
+// Largest chunk length the PNG spec allows
+const maxChunkLength = 1<<31 - 1
+
+var (
+	ErrSignature       = errors.New("invalid PNG signature")
+	ErrTruncated       = errors.New("PNG stream ended before IEND")
+	ErrChunkType       = errors.New("invalid chunk type")
+	ErrChunkLength     = errors.New("invalid chunk length")
+	ErrCRC             = errors.New("chunk CRC mismatch")
+	ErrIHDRFirst       = errors.New("first chunk is not IHDR")
+	ErrDuplicateIHDR   = errors.New("more than one IHDR chunk")
+	ErrDimensions      = errors.New("image dimensions out of range")
+	ErrTooManyChunks   = errors.New("too many chunks")
+	ErrTooLarge        = errors.New("PNG stream too large")
+	ErrUnknownCritical = errors.New("unknown critical chunk")
+)
+
+// ChunkError is a problem with one chunk of the stream, Err is one of the
+// errors above or a read or write error
+type ChunkError struct {
+	Index  int    // 0 is the first chunk after the signature
+	Type   string // empty if the header could not be read
+	Offset int64  // byte offset of the chunk in the input
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("PNG chunk %d at offset %d: %v", e.Index, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("PNG chunk %d (%q) at offset %d: %v", e.Index, e.Type, e.Offset, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error { return e.Err }
+
+// Limits bounds what Copy accepts. Zero values fall back to DefaultLimits.
+type Limits struct {
+	MaxWidth  uint32
+	MaxHeight uint32
+	MaxChunks int
+	MaxBytes  int64 // whole stream, signature included
+	// Drops text and EXIF chunks (tEXt, iTXt, zTXt, eXIf) from the output
+	StripAncillary bool
+}
+
+// Big enough for any framebuffer the clients have, small enough that a bad
+// writer cannot exhaust memory
+var DefaultLimits = Limits{
+	MaxWidth:  8192,
+	MaxHeight: 8192,
+	MaxChunks: 1 << 16,
+	MaxBytes:  64 << 20,
+}
+
+var strippedChunks = map[string]bool{"tEXt": true, "iTXt": true, "zTXt": true, "eXIf": true}
+
+// Critical chunks from the PNG spec, anything else with an uppercase first
+// letter cannot be decoded
+var criticalChunks = map[string]bool{"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxWidth == 0 {
+		l.MaxWidth = DefaultLimits.MaxWidth
+	}
+	if l.MaxHeight == 0 {
+		l.MaxHeight = DefaultLimits.MaxHeight
+	}
+	if l.MaxChunks <= 0 {
+		l.MaxChunks = DefaultLimits.MaxChunks
+	}
+	if l.MaxBytes <= 0 {
+		l.MaxBytes = DefaultLimits.MaxBytes
+	}
+	return l
+}
+
+func validChunkType(t []byte) bool {
+	for _, c := range t {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy reads one PNG from src and writes it to dst, stopping right after
+// IEND so src can carry more images. Each chunk is checked before it is
+// written, so dst never receives a chunk with a bad CRC. Returns the number
+// of bytes written.
+func Copy(dst io.Writer, src io.Reader, limits Limits) (int64, error) {
+	// src is read unbuffered, reading past IEND would eat the start of the
+	// next image
+	limits = limits.withDefaults()
+
+	var written int64
+	write := func(b []byte) error {
+		n, err := dst.Write(b)
+		written += int64(n)
+		return err
+	}
+
+	signature := make([]byte, len(Signature))
+	if _, err := io.ReadFull(src, signature); err != nil {
+		return 0, fmt.Errorf("failed to read PNG signature: %w", readError(err))
+	}
+	if !bytes.Equal(signature, Signature) {
+		return 0, ErrSignature
+	}
+	if err := write(signature); err != nil {
+		return written, fmt.Errorf("failed to write PNG signature: %w", err)
+	}
+
+	offset := int64(len(Signature))
+	header := make([]byte, 8)
+	var data []byte
+	for index := 0; ; index++ {
+		chunkErr := func(typ string, err error) error {
+			return &ChunkError{Index: index, Type: typ, Offset: offset, Err: err}
+		}
+		if index >= limits.MaxChunks {
+			return written, chunkErr("", ErrTooManyChunks)
+		}
+
+		if _, err := io.ReadFull(src, header); err != nil {
+			return written, chunkErr("", readError(err))
+		}
+		// big-endian classification in libpng/manuals/libpng-manual.txt line 3491
+		length := binary.BigEndian.Uint32(header[:4])
+		typeBytes := header[4:8]
+		if !validChunkType(typeBytes) {
+			return written, chunkErr(fmt.Sprintf("%x", typeBytes), ErrChunkType)
+		}
+		typ := string(typeBytes)
+		if length > maxChunkLength {
+			return written, chunkErr(typ, ErrChunkLength)
+		}
+		// Header, data and CRC must fit before anything is allocated
+		if offset+12+int64(length) > limits.MaxBytes {
+			return written, chunkErr(typ, ErrTooLarge)
+		}
+
+		switch {
+		case index == 0 && typ != "IHDR":
+			return written, chunkErr(typ, ErrIHDRFirst)
+		case index > 0 && typ == "IHDR":
+			return written, chunkErr(typ, ErrDuplicateIHDR)
+		case typ == "IHDR" && length != 13, typ == "IEND" && length != 0:
+			return written, chunkErr(typ, ErrChunkLength)
+		case typ[0] >= 'A' && typ[0] <= 'Z' && !criticalChunks[typ]:
+			return written, chunkErr(typ, ErrUnknownCritical)
+		}
+
+		if cap(data) < int(length)+4 {
+			data = make([]byte, int(length)+4)
+		}
+		data = data[:int(length)+4]
+		if _, err := io.ReadFull(src, data); err != nil {
+			return written, chunkErr(typ, readError(err))
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(typeBytes)
+		crc.Write(data[:length])
+		if crc.Sum32() != binary.BigEndian.Uint32(data[length:]) {
+			return written, chunkErr(typ, ErrCRC)
+		}
+
+		if typ == "IHDR" {
+			width := binary.BigEndian.Uint32(data[0:4])
+			height := binary.BigEndian.Uint32(data[4:8])
+			if width == 0 || height == 0 || width > limits.MaxWidth || height > limits.MaxHeight {
+				return written, chunkErr(typ, fmt.Errorf("%w: %dx%d, limit %dx%d", ErrDimensions, width, height, limits.MaxWidth, limits.MaxHeight))
+			}
+		}
+		offset += 12 + int64(length)
+
+		if limits.StripAncillary && strippedChunks[typ] {
+			continue
+		}
+		if err := write(header); err != nil {
+			return written, chunkErr(typ, fmt.Errorf("failed to write PNG chunk header: %w", err))
+		}
+		if err := write(data); err != nil {
+			return written, chunkErr(typ, fmt.Errorf("failed to write PNG chunk payload: %w", err))
+		}
+		if typ == "IEND" {
+			return written, nil
+		}
+	}
+}
+
+// Running out of input is always a truncated PNG, whether or not the
+// reader says so
+func readError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+//go:build linux && amd64
+
+package pngstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/png"
+	"io"
+	"testing"
+)
+
+func chunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+var (
+	ihdrChunk = chunk("IHDR", []byte{0, 0, 0, 2, 0, 0, 0, 2, 8, 0, 0, 0, 0}) // 2x2 grayscale
+	// zlib stream of two filter bytes and two pixels per line, all zero
+	idatChunk = chunk("IDAT", []byte{0x78, 0x9c, 0x63, 0x60, 0x00, 0x01, 0x00, 0x00, 0x06, 0x00, 0x01})
+	iendChunk = chunk("IEND", nil)
+)
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// A 2x2 PNG with extra chunks between IHDR and IDAT
+func testPNG(extra ...[]byte) []byte {
+	return join(Signature, ihdrChunk, join(extra...), idatChunk, iendChunk)
+}
+
+func TestCopyValid(t *testing.T) {
+	in := testPNG(chunk("tEXt", []byte("Comment\x00hello")))
+	var out bytes.Buffer
+	n, err := Copy(&out, bytes.NewReader(in), Limits{})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if n != int64(out.Len()) || !bytes.Equal(out.Bytes(), in) {
+		t.Errorf("Copy wrote %d bytes, want the %d input bytes unchanged", n, len(in))
+	}
+	if _, err := png.Decode(&out); err != nil {
+		t.Errorf("output does not decode: %v", err)
+	}
+}
+
+func TestCopyStripsAncillary(t *testing.T) {
+	for _, typ := range []string{"tEXt", "iTXt", "zTXt", "eXIf"} {
+		var out bytes.Buffer
+		if _, err := Copy(&out, bytes.NewReader(testPNG(chunk(typ, []byte("data")))), Limits{StripAncillary: true}); err != nil {
+			t.Fatalf("%s: Copy: %v", typ, err)
+		}
+		if !bytes.Equal(out.Bytes(), testPNG()) {
+			t.Errorf("%s: chunk not stripped", typ)
+		}
+	}
+
+	// Other ancillary chunks are kept
+	in := testPNG(chunk("gAMA", []byte{0, 0, 0xb1, 0x8f}))
+	var out bytes.Buffer
+	if _, err := Copy(&out, bytes.NewReader(in), Limits{StripAncillary: true}); err != nil {
+		t.Fatalf("gAMA: Copy: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), in) {
+		t.Error("gAMA: chunk stripped")
+	}
+}
+
+func TestCopyStopsAtIEND(t *testing.T) {
+	first := testPNG()
+	second := testPNG(chunk("tIME", []byte{0x07, 0xea, 1, 2, 3, 4, 5}))
+	src := bytes.NewReader(join(first, second))
+	for i, want := range [][]byte{first, second} {
+		var out bytes.Buffer
+		if _, err := Copy(&out, src, Limits{}); err != nil {
+			t.Fatalf("image %d: Copy: %v", i, err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("image %d: output differs from input", i)
+		}
+	}
+	if src.Len() != 0 {
+		t.Errorf("%d bytes left unread", src.Len())
+	}
+}
+
+func TestCopyErrors(t *testing.T) {
+	badCRC := testPNG()
+	badCRC[len(Signature)+len(ihdrChunk)+10] ^= 0xff
+
+	tooMany := make([][]byte, 20)
+	for i := range tooMany {
+		tooMany[i] = chunk("prVt", nil)
+	}
+
+	tests := []struct {
+		name   string
+		in     []byte
+		limits Limits
+		err    error
+		index  int    // of the chunk in the ChunkError
+		typ    string // of the chunk in the ChunkError
+	}{
+		{"bad CRC", badCRC, Limits{}, ErrCRC, 1, "IDAT"},
+		{"IHDR not first", join(Signature, idatChunk, ihdrChunk, iendChunk), Limits{}, ErrIHDRFirst, 0, "IDAT"},
+		{"duplicate IHDR", join(Signature, ihdrChunk, ihdrChunk, iendChunk), Limits{}, ErrDuplicateIHDR, 1, "IHDR"},
+		{"missing IEND", join(Signature, ihdrChunk, idatChunk), Limits{}, ErrTruncated, 2, ""},
+		{"truncated chunk", testPNG()[:len(Signature)+len(ihdrChunk)+6], Limits{}, ErrTruncated, 1, ""},
+		{"length over spec", join(Signature, ihdrChunk, []byte{0x80, 0, 0, 0}, []byte("IDAT")), Limits{}, ErrChunkLength, 1, "IDAT"},
+		{"length over max bytes", join(Signature, ihdrChunk, []byte{0x7f, 0xff, 0xff, 0xff}, []byte("IDAT")), Limits{}, ErrTooLarge, 1, "IDAT"},
+		{"stream over max bytes", testPNG(), Limits{MaxBytes: 40}, ErrTooLarge, 1, "IDAT"},
+		{"IEND with data", join(Signature, ihdrChunk, idatChunk, chunk("IEND", []byte{0})), Limits{}, ErrChunkLength, 2, "IEND"},
+		{"too many chunks", testPNG(tooMany...), Limits{MaxChunks: 16}, ErrTooManyChunks, 16, ""},
+		{"invalid chunk type", testPNG(chunk("bK1D", nil)), Limits{}, ErrChunkType, 1, "624b3144"},
+		{"unknown critical chunk", testPNG(chunk("ABCD", nil)), Limits{}, ErrUnknownCritical, 1, "ABCD"},
+		{"too wide", testPNG(), Limits{MaxWidth: 1}, ErrDimensions, 0, "IHDR"},
+		{"zero height", join(Signature, chunk("IHDR", []byte{0, 0, 0, 2, 0, 0, 0, 0, 8, 0, 0, 0, 0}), iendChunk), Limits{}, ErrDimensions, 0, "IHDR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := Copy(&out, bytes.NewReader(tt.in), tt.limits)
+			var chunkErr *ChunkError
+			if !errors.As(err, &chunkErr) {
+				t.Fatalf("Copy = %v, want a *ChunkError", err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Copy = %v, want %v", err, tt.err)
+			}
+			if chunkErr.Index != tt.index || chunkErr.Type != tt.typ {
+				t.Errorf("chunk %d %q, want %d %q", chunkErr.Index, chunkErr.Type, tt.index, tt.typ)
+			}
+			if n != int64(out.Len()) {
+				t.Errorf("Copy returned %d, wrote %d bytes", n, out.Len())
+			}
+			// Only whole chunks before the bad one are written
+			if !bytes.HasPrefix(tt.in, out.Bytes()) || int64(out.Len()) > chunkErr.Offset {
+				t.Errorf("wrote %d bytes, bad chunk starts at %d", out.Len(), chunkErr.Offset)
+			}
+		})
+	}
+}
+
+func TestCopySignatureErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"short", Signature[:4], ErrTruncated},
+		{"not a PNG", []byte("GIF89a\x00\x00\x00\x00"), ErrSignature},
+	}
+	for _, tt := range tests {
+		n, err := Copy(io.Discard, bytes.NewReader(tt.in), Limits{})
+		if !errors.Is(err, tt.err) || n != 0 {
+			t.Errorf("%s: Copy = %d, %v, want 0, %v", tt.name, n, err, tt.err)
+		}
+		var chunkErr *ChunkError
+		if errors.As(err, &chunkErr) {
+			t.Errorf("%s: signature error is a *ChunkError", tt.name)
+		}
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestCopyWriteError(t *testing.T) {
+	errWrite := errors.New("disk full")
+	if _, err := Copy(failingWriter{errWrite}, bytes.NewReader(testPNG()), Limits{}); !errors.Is(err, errWrite) {
+		t.Errorf("Copy = %v, want %v", err, errWrite)
+	}
+}
+
+// Seeds in testdata/fuzz/FuzzCopy cover every error and each stripped chunk
+func FuzzCopy(f *testing.F) {
+	f.Add(testPNG())
+	limits := Limits{MaxWidth: 64, MaxHeight: 64, MaxChunks: 16, MaxBytes: 4096, StripAncillary: true}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		var out bytes.Buffer
+		n, err := Copy(&out, bytes.NewReader(in), limits)
+		if n != int64(out.Len()) {
+			t.Fatalf("Copy returned %d, wrote %d bytes", n, out.Len())
+		}
+		if err != nil {
+			var chunkErr *ChunkError
+			if errors.As(err, &chunkErr) && int64(out.Len()) > chunkErr.Offset {
+				t.Fatalf("wrote %d bytes, bad chunk starts at %d", out.Len(), chunkErr.Offset)
+			}
+			return
+		}
+
+		// A stream Copy accepted is accepted again unchanged, without the
+		// chunks it strips
+		var again bytes.Buffer
+		if _, err := Copy(&again, bytes.NewReader(out.Bytes()), limits); err != nil {
+			t.Fatalf("output rejected: %v", err)
+		}
+		if !bytes.Equal(again.Bytes(), out.Bytes()) {
+			t.Fatal("output changed when copied again")
+		}
+		if !bytes.HasSuffix(out.Bytes(), iendChunk) {
+			t.Fatal("output does not end with IEND")
+		}
+		for offset := len(Signature); offset < out.Len(); {
+			length := int(binary.BigEndian.Uint32(out.Bytes()[offset:]))
+			if typ := string(out.Bytes()[offset+4 : offset+8]); strippedChunks[typ] {
+				t.Fatalf("%s chunk not stripped", typ)
+			}
+			offset += 12 + length
+		}
+	})
+}
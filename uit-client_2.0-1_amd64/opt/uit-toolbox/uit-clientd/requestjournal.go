@@ -0,0 +1,156 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"uit-clientd/journal"
+	"uit-clientd/keypolicy"
+	"uit-clientd/logging"
+	"uit-clientd/retry"
+)
+
+const (
+	requestJournalFile    = "request-journal.jsonl"
+	requestJournalBackups = 3
+	// Values are cut to this length even when the policy allows them
+	maxJournalValueLength = 256
+	defaultHistoryLimit   = 100
+)
+
+var requestJournal atomic.Pointer[journal.Journal]
+
+func requestJournalPath() string {
+	return filepath.Join(daemonSettings.Load().StateDir, requestJournalFile)
+}
+
+// Starts a journal entry for a request. input is the raw socket line, so
+// requests that fail validation still get their key recorded.
+func newJournalEntry(source string, input string, payload *HTTPRequestPayload) journal.Entry {
+	if payload == nil {
+		payload = &HTTPRequestPayload{}
+		_ = json.Unmarshal([]byte(input), payload)
+		payload.Key = strings.TrimSpace(payload.Key)
+	}
+	e := journal.Entry{
+		Time:       time.Now().UTC(),
+		Source:     source,
+		Key:        payload.Key,
+		Method:     strings.ToUpper(strings.TrimSpace(payload.RequestType)),
+		Validation: "ok",
+	}
+	rule, _ := keypolicy.Lookup(payload.Key)
+	if e.Method == "" {
+		e.Method = rule.Method
+	}
+	if payload.TransactionUUID != nil {
+		e.TransactionUUID = strings.TrimSpace(*payload.TransactionUUID)
+	}
+	if value := strings.TrimSpace(payload.StringValue); value != "" {
+		if rule.LogValue {
+			e.Value = value[:min(len(value), maxJournalValueLength)]
+		} else {
+			e.Redacted = true
+		}
+	}
+	return e
+}
+
+// Fills in how a request ended, counts it and appends the entry. A journal
+// that cannot be written is logged, it never fails the request.
+func recordRequest(e journal.Entry, start time.Time, outcome string, status int, err error) {
+	latency := time.Since(start)
+	requestsHandled.Inc(e.Source, metricKey(e.Key), outcome)
+	requestLatency.Observe(latency.Seconds(), metricKey(e.Key))
+
+	j := requestJournal.Load()
+	if j == nil {
+		return
+	}
+	if rule, ok := keypolicy.Lookup(e.Key); ok && rule.NoJournal {
+		return
+	}
+	e.Outcome = outcome
+	e.HTTPStatus = status
+	e.LatencyMS = float64(latency.Microseconds()) / 1000
+	if err != nil {
+		e.Error = err.Error()
+		var statusErr *retry.StatusError
+		if e.HTTPStatus == 0 && errors.As(err, &statusErr) {
+			e.HTTPStatus = statusErr.StatusCode
+		}
+	}
+	if err := j.Append(e); err != nil {
+		logging.Component("journal").Error("cannot record request", logging.Key(e.Key), "error", err)
+	}
+}
+
+// Answers a history query. The value is URL query encoded:
+//
+//	key=<key>                only this key
+//	transaction_uuid=<uuid>  only this job
+//	since=<RFC3339 time>     only entries at or after this time
+//	until=<RFC3339 time>     only entries at or before this time
+//	window=<duration>        only entries from the last duration
+//	limit=<n>                at most the n newest entries (default 100)
+func queryRequestHistory(value string) (string, error) {
+	j := requestJournal.Load()
+	if j == nil {
+		return "", fmt.Errorf("request journal is not available")
+	}
+	q, err := url.ParseQuery(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("invalid history query '%s': %w", value, err)
+	}
+	f := journal.Filter{
+		Key:             q.Get("key"),
+		TransactionUUID: q.Get("transaction_uuid"),
+		Limit:           defaultHistoryLimit,
+	}
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return "", fmt.Errorf("invalid since '%s': %w", v, err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return "", fmt.Errorf("invalid until '%s': %w", v, err)
+		}
+	}
+	if v := q.Get("window"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return "", fmt.Errorf("invalid window '%s'", v)
+		}
+		if from := time.Now().Add(-window); from.After(f.Since) {
+			f.Since = from
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			return "", fmt.Errorf("invalid limit '%s'", v)
+		}
+	}
+
+	entries, err := j.Query(f)
+	if err != nil {
+		return "", err
+	}
+	if entries == nil {
+		entries = []journal.Entry{}
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal history: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package requests
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	siocEthtool       = 0x8946 // SIOCETHTOOL, include/uapi/linux/sockios.h
+	ethtoolGPermAddr  = 0x20   // ETHTOOL_GPERMADDR, include/uapi/linux/ethtool.h
+	ethtoolMaxAddrLen = 32
+)
+
+// struct ethtool_perm_addr with room for the address
+type ethtoolPermAddr struct {
+	cmd  uint32
+	size uint32
+	data [ethtoolMaxAddrLen]byte
+}
+
+// struct ifreq with ifr_data
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+// Reads the factory MAC address of an interface, which stays the same
+// even if the current address has been changed or randomized.
+func getPermanentMAC(ifName string) (net.HardwareAddr, error) {
+	if len(ifName) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: '%s'", ifName)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open socket for ethtool: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	permAddr := ethtoolPermAddr{cmd: ethtoolGPermAddr, size: ethtoolMaxAddrLen}
+	var ifr ifreqData
+	copy(ifr.name[:], ifName)
+	ifr.data = unsafe.Pointer(&permAddr)
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return nil, fmt.Errorf("ETHTOOL_GPERMADDR failed for '%s': %w", ifName, errno)
+	}
+	if permAddr.size == 0 || permAddr.size > ethtoolMaxAddrLen {
+		return nil, fmt.Errorf("ETHTOOL_GPERMADDR returned invalid size %d for '%s'", permAddr.size, ifName)
+	}
+	mac := make(net.HardwareAddr, permAddr.size)
+	copy(mac, permAddr.data[:permAddr.size])
+	return mac, nil
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -19,34 +21,182 @@ type ClientLookupRow struct {
 	LastInventoryEntry *time.Time `json:"last_inventory_entry,omitempty"`
 }
 
+type IdentitySource string
+
 const (
-	systemSerialPath = "/sys/class/dmi/id/product_serial"
+	IdentitySourceProductSerial IdentitySource = "product_serial"
+	IdentitySourceBoardSerial   IdentitySource = "board_serial"
+	IdentitySourceChassisSerial IdentitySource = "chassis_serial"
+	IdentitySourceProductUUID   IdentitySource = "product_uuid"
+	IdentitySourcePermanentMAC  IdentitySource = "permanent_mac"
 )
 
-var (
-	systemSerialBuf   bytes.Buffer
-	systemSerialBufMu sync.Mutex
+const (
+	dmiRootDir = "/sys/class/dmi/id/"
 )
 
-func GetSerial(ctx context.Context) (string, error) {
-	if ctx.Err() != nil {
-		return "", ctx.Err()
+// ErrTagNotFound is returned when the server has no tag number for a serial yet
+var ErrTagNotFound = errors.New("no tag number assigned to system serial")
+
+// ErrNoIdentity is returned while none of the identity sources can be read,
+// which early in boot may only mean sysfs is not populated yet
+var ErrNoIdentity = errors.New("no usable system identity")
+
+// SystemIdentity is the value used as system_serial, and where it was read from
+type SystemIdentity struct {
+	Serial string
+	Source IdentitySource
+}
+
+// Weak reports whether the identity did not come from the system serial,
+// so it may not match the sticker on the machine.
+func (id SystemIdentity) Weak() bool {
+	return id.Source != IdentitySourceProductSerial
+}
+
+// Placeholder values that vendors leave in DMI fields, compared lowercase
+var identityDenylist = map[string]struct{}{
+	"to be filled by o.e.m.":               {},
+	"to be filled by oem":                  {},
+	"default string":                       {},
+	"system serial number":                 {},
+	"chassis serial number":                {},
+	"base board serial number":             {},
+	"serial number":                        {},
+	"not specified":                        {},
+	"not applicable":                       {},
+	"not available":                        {},
+	"none":                                 {},
+	"null":                                 {},
+	"n/a":                                  {},
+	"na":                                   {},
+	"oem":                                  {},
+	"o.e.m.":                               {},
+	"invalid":                              {},
+	"unknown":                              {},
+	"empty":                                {},
+	"0123456789":                           {},
+	"123456789":                            {},
+	"1234567890":                           {},
+	"03000200-0400-0500-0006-000700080009": {},
+}
+
+func isPlaceholderIdentity(v string) bool {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return true
+	}
+	if _, ok := identityDenylist[v]; ok {
+		return true
+	}
+	// Values made of a single repeated character, ignoring separators,
+	// ex. 00000000, FFFFFFFF-FFFF-FFFF-FFFF-FFFFFFFFFFFF, ........
+	stripped := strings.NewReplacer("-", "", ":", "", " ", "").Replace(v)
+	if stripped == "" {
+		return true
 	}
-	f, err := os.Open(systemSerialPath)
+	return strings.Count(stripped, stripped[:1]) == len(stripped)
+}
+
+func readDMIIdentity(name string) (string, error) {
+	path := filepath.Join(dmiRootDir, name)
+	b, err := os.ReadFile(path)
 	if err != nil {
-		return "", fmt.Errorf("cannot open '%s': %w", systemSerialPath, err)
+		return "", fmt.Errorf("cannot read '%s': %w", path, err)
+	}
+	v := strings.TrimSpace(string(b))
+	if isPlaceholderIdentity(v) {
+		return "", fmt.Errorf("'%s' has placeholder value '%s'", path, v)
+	}
+	return v, nil
+}
+
+// Returns the permanent MAC of the first onboard wired NIC, by interface name.
+// USB and virtual interfaces are skipped since they can move between machines.
+func getOnboardPermanentMAC() (string, error) {
+	netDirs, err := os.ReadDir(netIfRootDir)
+	if err != nil {
+		return "", fmt.Errorf("error reading dir '%s': %w", netIfRootDir, err)
+	}
+	var errs []error
+	for _, dir := range netDirs { // ReadDir is sorted by name
+		ifDir := filepath.Join(netIfRootDir, dir.Name())
+		typeBytes, err := os.ReadFile(filepath.Join(ifDir, "type"))
+		if err != nil || strings.TrimSpace(string(typeBytes)) != "1" { // ARPHRD_ETHER
+			continue
+		}
+		devicePath, err := filepath.EvalSymlinks(filepath.Join(ifDir, "device"))
+		if err != nil || strings.Contains(devicePath, "/usb") || strings.Contains(devicePath, "/virtual/") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(ifDir, "wireless")); err == nil {
+			continue
+		}
+
+		mac, err := getPermanentMAC(dir.Name())
+		if err != nil {
+			// Fall back to the current address, only if the kernel says it is the permanent one
+			assignType, _ := os.ReadFile(filepath.Join(ifDir, "addr_assign_type"))
+			if strings.TrimSpace(string(assignType)) != "0" { // NET_ADDR_PERM
+				errs = append(errs, err)
+				continue
+			}
+			addr, readErr := os.ReadFile(filepath.Join(ifDir, "address"))
+			if readErr != nil {
+				errs = append(errs, readErr)
+				continue
+			}
+			mac, err = net.ParseMAC(strings.TrimSpace(string(addr)))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if len(mac) != 6 || mac[0]&0x02 != 0 || isPlaceholderIdentity(mac.String()) {
+			errs = append(errs, fmt.Errorf("'%s' has no usable permanent MAC: '%s'", dir.Name(), mac))
+			continue
+		}
+		return mac.String(), nil
+	}
+	if len(errs) > 0 {
+		return "", fmt.Errorf("no onboard NIC with a permanent MAC: %w", errors.Join(errs...))
+	}
+	return "", fmt.Errorf("no onboard NIC with a permanent MAC")
+}
+
+// ResolveIdentity walks the identity sources in order of preference and
+// returns the first one that is not empty or a known placeholder.
+func ResolveIdentity(ctx context.Context) (SystemIdentity, error) {
+	sources := []struct {
+		source IdentitySource
+		read   func() (string, error)
+	}{
+		{IdentitySourceProductSerial, func() (string, error) { return readDMIIdentity("product_serial") }},
+		{IdentitySourceBoardSerial, func() (string, error) { return readDMIIdentity("board_serial") }},
+		{IdentitySourceChassisSerial, func() (string, error) { return readDMIIdentity("chassis_serial") }},
+		{IdentitySourceProductUUID, func() (string, error) { return readDMIIdentity("product_uuid") }},
+		{IdentitySourcePermanentMAC, getOnboardPermanentMAC},
 	}
-	systemSerialBufMu.Lock()
-	defer systemSerialBufMu.Unlock()
 
-	systemSerialBuf.Reset()
-	systemSerialBuf.ReadFrom(f)
-	return strings.TrimSpace(string(systemSerialBuf.String())), nil
+	var errs []error
+	for _, src := range sources {
+		if ctx.Err() != nil {
+			return SystemIdentity{}, ctx.Err()
+		}
+		v, err := src.read()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", src.source, err))
+			continue
+		}
+		return SystemIdentity{Serial: v, Source: src.source}, nil
+	}
+	return SystemIdentity{}, fmt.Errorf("%w (ResolveIdentity): %w", ErrNoIdentity, errors.Join(errs...))
 }
 
-func GetTagFromSerial(ctx context.Context, s string) (int64, error) {
+func GetTagFromSerial(ctx context.Context, id SystemIdentity) (int64, error) {
 	q := url.Values{}
-	q.Set("system_serial", s)
+	q.Set("system_serial", id.Serial)
+	q.Set("system_serial_source", string(id.Source))
 
 	var response bytes.Buffer
 	if err := getRequest(
@@ -55,15 +205,26 @@ func GetTagFromSerial(ctx context.Context, s string) (int64, error) {
 			Path:     "/api/client/lookup_ids",
 			RawQuery: q.Encode(),
 		}, &response); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return 0, ErrTagNotFound
+		}
 		return 0, fmt.Errorf("error in GetTagFromSerial: %w", err)
 	}
 
+	body := bytes.TrimSpace(response.Bytes())
+	if len(body) == 0 || bytes.Equal(body, []byte("null")) || bytes.Equal(body, []byte("{}")) {
+		return 0, ErrTagNotFound
+	}
+
 	var clr ClientLookupRow
-	if err := json.Unmarshal(response.Bytes(), &clr); err != nil {
+	if err := json.Unmarshal(body, &clr); err != nil {
 		return 0, fmt.Errorf("cannot unmarshal JSON (GetTagFromSerial): %v", err)
 	}
 
-	if clr.Tagnumber == nil || *clr.Tagnumber < 100000 || *clr.Tagnumber > 999999 {
+	if clr.Tagnumber == nil {
+		return 0, ErrTagNotFound
+	}
+	if *clr.Tagnumber < 100000 || *clr.Tagnumber > 999999 {
 		return 0, fmt.Errorf("tagnumber invalid or out of range (GetTagFromSerial)")
 	}
 
@@ -2,25 +2,38 @@ package requests
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/metrics"
 )
 
 const (
-	appLastHeardFilePath  = "/tmp/uit_app_last_heard"
-	appUptimeFilePath     = "/tmp/uit_app_uptime"
-	kernelUpdatedFilePath = "/tmp/uit_kernel_updated"
+	appStatusFileName  = "app_status.json"
+	bootIDFilePath     = "/proc/sys/kernel/random/boot_id"
+	procUptimeFilePath = "/proc/uptime"
+	osReleaseFilePath  = "/proc/sys/kernel/osrelease"
+	kernelModulesDir   = "/lib/modules"
+	powerSupplyDir     = "/sys/class/power_supply/"
+
+	// Server contact is saved to disk at most this often, polls happen every few seconds
+	lastHeardSaveInterval = time.Minute
 )
 
 var (
-	appLastHeardBufMu  sync.Mutex
-	appLastHeardBuf    bytes.Buffer
-	appUptimeBufMu     sync.Mutex
-	appUptimeBuf       bytes.Buffer
-	kernelUpdatedBufMu sync.Mutex
-	kernelUpdatedBuf   bytes.Buffer
+	serverResponses = metrics.NewCounter("uit_clientd_server_responses_total",
+		"Requests to the server by HTTP status code, error if there was no response", "code")
+	serverLatency = metrics.NewHistogram("uit_clientd_server_request_duration_seconds",
+		"Time until the server responded, or the request failed", nil, "method")
 )
 
 type AppStatusRequest struct {
@@ -33,128 +46,201 @@ type AppStatusRequest struct {
 	SystemUptime  time.Duration `json:"system_uptime"`
 }
 
-func getKernelUpdated() (bool, error) {
-	f, err := os.Open(kernelUpdatedFilePath)
-	if err != nil {
-		return false, fmt.Errorf("cannot open '%s' for reading: %w", kernelUpdatedFilePath, err)
-	}
-	defer f.Close()
-
-	kernelUpdatedBufMu.Lock()
-	defer kernelUpdatedBufMu.Unlock()
-
-	kernelUpdatedBuf.Reset()
-	if _, err := kernelUpdatedBuf.ReadFrom(f); err != nil {
-		return false, fmt.Errorf("cannot read '%s': %w", kernelUpdatedFilePath, err)
-	}
-
-	if kernelUpdatedBuf.String() != "true" {
-		return false, nil
-	}
+// What survives a restart of uit-clientd. The start time is only kept while
+// the boot ID matches, so the app uptime restarts with the system.
+type persistedAppStatus struct {
+	BootID    string    `json:"boot_id"`
+	StartedAt time.Time `json:"started_at"`
+	LastHeard time.Time `json:"last_heard"`
+}
 
-	return true, nil
+type appStatusTracker struct {
+	mu        sync.Mutex
+	path      string
+	bootID    string
+	startedAt time.Time
+	lastHeard time.Time
+	lastSaved time.Time
+	// Whether the last request got any HTTP response from the server
+	online *bool
 }
 
-func getLastHeard() (time.Time, error) {
-	f, err := os.Open(appLastHeardFilePath)
-	if err != nil {
-		return time.Time{}, err
-	}
-	defer f.Close()
+var appStatus = &appStatusTracker{startedAt: time.Now()}
 
-	appLastHeardBufMu.Lock()
-	defer appLastHeardBufMu.Unlock()
+// InitAppStatus loads the app status saved under stateDir by a previous run
+// of uit-clientd and starts saving to it. Call once before any requests.
+func InitAppStatus(stateDir string) error {
+	t := appStatus
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	appLastHeardBuf.Reset()
-	if _, err := kernelUpdatedBuf.ReadFrom(f); err != nil {
-		return time.Time{}, fmt.Errorf("cannot read '%s': %w", appLastHeardFilePath, err)
+	t.path = filepath.Join(stateDir, appStatusFileName)
+	if b, err := os.ReadFile(bootIDFilePath); err == nil {
+		t.bootID = strings.TrimSpace(string(b))
 	}
 
-	if len(appLastHeardBuf.Bytes()) == 0 {
-		return time.Time{}, fmt.Errorf("old last heard value missing/nil (getLastHeard)")
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t.saveLocked()
 	}
-	timeParsed, err := time.Parse(time.RFC3339, appLastHeardBuf.String())
 	if err != nil {
-		return time.Time{}, err
+		return fmt.Errorf("cannot read app status '%s': %w", t.path, err)
+	}
+	var prev persistedAppStatus
+	if err := json.Unmarshal(data, &prev); err != nil {
+		return fmt.Errorf("cannot parse app status '%s': %w", t.path, err)
+	}
+	t.lastHeard = prev.LastHeard
+	if t.bootID != "" && prev.BootID == t.bootID && !prev.StartedAt.IsZero() {
+		t.startedAt = prev.StartedAt // restarted by systemd, same boot
 	}
-	fmt.Printf("Old app last heard value: %s\n", timeParsed.Format(time.RFC3339))
-	return timeParsed, nil
+	return t.saveLocked()
 }
 
-func updateLastHeard(t time.Time) error {
-	if t.IsZero() {
-		return fmt.Errorf("time value required (updateLastHeard)")
+// Called with t.mu held
+func (t *appStatusTracker) saveLocked() error {
+	if t.path == "" {
+		return nil
 	}
-	nowStrFormatted := t.Format(time.RFC3339)
-
-	appLastHeardBufMu.Lock()
-	defer appLastHeardBufMu.Unlock()
-
-	appLastHeardBuf.Reset()
-	appLastHeardBuf.WriteString(nowStrFormatted)
-
-	if err := os.WriteFile(appLastHeardFilePath, appLastHeardBuf.Bytes(), 0644); err != nil {
-		return err
+	data, err := json.Marshal(persistedAppStatus{
+		BootID:    t.bootID,
+		StartedAt: t.startedAt,
+		LastHeard: t.lastHeard,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal app status: %w", err)
 	}
-
-	fmt.Printf("New app last heard value: %s\n", nowStrFormatted)
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory for '%s': %w", t.path, err)
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("cannot write '%s': %w", tmp, err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("cannot rename '%s' to '%s': %w", tmp, t.path, err)
+	}
+	t.lastSaved = time.Now()
 	return nil
 }
 
-func getAppUptime() (time.Duration, error) {
-	f, err := os.Open(appUptimeFilePath)
-	if err != nil {
-		return 0, err
+// RecordServerResponse is called after every request to the server. A 2xx
+// response counts as contact, any HTTP response means the server is online.
+func RecordServerResponse(method string, statusCode int, latency time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return // says nothing about the server
+	}
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(statusCode)
 	}
-	defer f.Close()
+	serverResponses.Inc(code)
+	serverLatency.Observe(latency.Seconds(), method)
 
-	appUptimeBufMu.Lock()
-	defer appUptimeBufMu.Unlock()
+	t := appStatus
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	appUptimeBuf.Reset()
-	if _, err := kernelUpdatedBuf.ReadFrom(f); err != nil {
-		return 0, fmt.Errorf("cannot read '%s': %w", appUptimeFilePath, err)
+	online := err == nil
+	t.online = &online
+	if err != nil || statusCode < 200 || statusCode > 299 {
+		return
 	}
-
-	initialTimeVal, err := time.Parse(time.RFC3339, appUptimeBuf.String())
-	if err != nil {
-		return 0, fmt.Errorf("cannot parse initialTimeVal (getAppUptime): %w\n", err)
+	t.lastHeard = time.Now()
+	if time.Since(t.lastSaved) < lastHeardSaveInterval {
+		return
 	}
+	if err := t.saveLocked(); err != nil {
+		logging.Component("app_status").Error("failed to save app status", "error", err)
+	}
+}
 
-	uptime := time.Since(initialTimeVal)
-
-	fmt.Printf("New app uptime value: %s\n", uptime)
-	return time.Duration(uptime), nil
+// LastHeard returns the time of the last successful response from the server,
+// zero if there never was one
+func LastHeard() time.Time {
+	appStatus.mu.Lock()
+	defer appStatus.mu.Unlock()
+	return appStatus.lastHeard
 }
 
-func updateAppUptime(t time.Time) error {
-	if t.IsZero() {
-		return fmt.Errorf("time value required (updateAppUptime)")
+// GetAppStatus fills an AppStatusRequest, current is what the client is doing right now
+func GetAppStatus(current string) *AppStatusRequest {
+	t := appStatus
+	t.mu.Lock()
+	status := &AppStatusRequest{
+		AppUptime: int64(time.Since(t.startedAt).Seconds()),
+		Current:   current,
+		IsOnline:  t.online,
+		LastHeard: t.lastHeard,
 	}
-	appUptimeBufMu.Lock()
-	defer appUptimeBufMu.Unlock()
-
-	appUptimeBuf.Reset()
-	appUptimeBuf.WriteString(t.Format(time.RFC3339))
+	t.mu.Unlock()
 
-	if err := os.WriteFile(appUptimeFilePath, appUptimeBuf.Bytes(), 0644); err != nil {
-		return err
+	if uptime, err := getSystemUptime(); err == nil {
+		status.SystemUptime = uptime
 	}
-	fmt.Printf("Old app uptime value: %s\n", appUptimeBuf.String())
-	return nil
+	if updated, err := getKernelUpdated(); err == nil {
+		status.KernelUpdated = &updated
+	}
+	if pluggedIn, err := getPluggedIn(); err == nil {
+		status.IsPluggedIn = &pluggedIn
+	}
+	return status
 }
 
-func printAppData() {
-	if _, err := getLastHeard(); err != nil {
-		fmt.Printf("getLastHeard error: %v\n", err)
+func getSystemUptime() (time.Duration, error) {
+	data, err := os.ReadFile(procUptimeFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read '%s': %w", procUptimeFilePath, err)
 	}
-	if err := updateLastHeard(time.Now()); err != nil {
-		fmt.Printf("updateLastHeard error: %v\n", err)
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("'%s' is empty", procUptimeFilePath)
 	}
-	if _, err := getAppUptime(); err != nil {
-		fmt.Printf("getAppUptime error: %v\n", err)
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse system uptime '%s': %w", fields[0], err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// The running kernel is up to date if its modules are still installed
+func getKernelUpdated() (bool, error) {
+	b, err := os.ReadFile(osReleaseFilePath)
+	if err != nil {
+		return false, fmt.Errorf("cannot read '%s': %w", osReleaseFilePath, err)
 	}
-	if err := updateAppUptime(time.Now()); err != nil {
-		fmt.Printf("updateAppUptime error: %v\n", err)
+	release := strings.TrimSpace(string(b))
+	if _, err := os.Stat(filepath.Join(kernelModulesDir, release)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
 	}
+	return true, nil
+}
+
+// Plugged in if any mains supply is online. Systems without one (most
+// desktops) cannot run on battery, so they count as plugged in.
+func getPluggedIn() (bool, error) {
+	entries, err := os.ReadDir(powerSupplyDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot read '%s': %w", powerSupplyDir, err)
+	}
+	foundMains := false
+	for _, entry := range entries {
+		typ, err := os.ReadFile(filepath.Join(powerSupplyDir, entry.Name(), "type"))
+		if err != nil || strings.TrimSpace(string(typ)) != "Mains" {
+			continue
+		}
+		foundMains = true
+		online, err := os.ReadFile(filepath.Join(powerSupplyDir, entry.Name(), "online"))
+		if err == nil && bytes.Equal(bytes.TrimSpace(online), []byte("1")) {
+			return true, nil
+		}
+	}
+	return !foundMains, nil
 }
@@ -1,5 +1,17 @@
 package requests
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"uit-clientd/metrics"
+)
+
 const (
 	hwmonDirRoot     = "/sys/class/hwmon/"
 	powercapRootDir  = "/sys/class/powercap/"
@@ -8,8 +20,68 @@ const (
 )
 
 type LiveDataRequest struct {
-	Hardware   *HardwareDataRequest        `json:"hardware"`
-	Job        *ClientJobQueueDataResponse `json:"job"`
-	Status     *AppStatusRequest           `json:"status"`
-	Screenshot []byte                      `json:"live_screenshot"`
+	Tagnumber    int64                       `json:"tagnumber,omitempty"` // 0 until enrolled
+	SystemSerial string                      `json:"system_serial"`
+	SampledAt    time.Time                   `json:"sampled_at"`
+	Hardware     *HardwareDataRequest        `json:"hardware"`
+	Job          *ClientJobQueueDataResponse `json:"job"`
+	Status       *AppStatusRequest           `json:"status"`
+	Screenshot   []byte                      `json:"live_screenshot"`
+	Metrics      []metrics.Family            `json:"metrics,omitempty"` // only in some reports
+}
+
+// PostLiveData sends all live data of the client as one document
+func PostLiveData(ctx context.Context, data *LiveDataRequest) error {
+	if data == nil {
+		return fmt.Errorf("live data is nil (PostLiveData)")
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("cannot marshal LiveDataRequest JSON (PostLiveData): %w", err)
+	}
+
+	q := ClientQuery(data.Tagnumber, data.SystemSerial)
+	return postRequest(
+		ctx,
+		url.URL{
+			Path:     "/api/v2/app/live/data",
+			RawQuery: q.Encode(),
+		},
+		"application/json; charset=utf-8",
+		bytes.NewReader(body),
+	)
+}
+
+// PostLastHeard tells the server when it last heard from the client
+func PostLastHeard(ctx context.Context, tag int64, serial string, t time.Time) error {
+	body, err := json.Marshal(struct {
+		Tagnumber    int64     `json:"tagnumber,omitempty"`
+		SystemSerial string    `json:"system_serial"`
+		LastHeard    time.Time `json:"last_heard"`
+	}{Tagnumber: tag, SystemSerial: serial, LastHeard: t.UTC()})
+	if err != nil {
+		return fmt.Errorf("cannot marshal last heard JSON (PostLastHeard): %w", err)
+	}
+	return postRequest(
+		ctx,
+		url.URL{Path: "/api/client/last_heard"},
+		"application/json; charset=utf-8",
+		bytes.NewReader(body),
+	)
+}
+
+// PostLiveScreenshot streams an encoded screenshot of the client's screen from
+// image, contentType is its image type (image/png or image/jpeg). The size is
+// not known up front, so the body is sent in chunks.
+func PostLiveScreenshot(ctx context.Context, tag int64, serial string, contentType string, image io.Reader) error {
+	q := ClientQuery(tag, serial)
+	return postRequest(
+		ctx,
+		url.URL{
+			Path:     "/api/client/live_screenshot",
+			RawQuery: q.Encode(),
+		},
+		contentType,
+		image,
+	)
 }
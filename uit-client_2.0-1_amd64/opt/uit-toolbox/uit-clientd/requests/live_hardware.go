@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -15,6 +16,13 @@ import (
 	"time"
 )
 
+// ErrNoDiskSensor is returned by GetDiskData on systems without an NVMe temperature sensor
+var ErrNoDiskSensor = errors.New("no NVMe temperature sensor")
+
+// ErrNoPowercap means the kernel exposes no powercap energy counter, common on
+// AMD and older Intel systems
+var ErrNoPowercap = errors.New("no powercap energy counter")
+
 type HardwareDataRequest struct {
 	BatteryChargePcnt int64   `json:"battery_charge_pcnt"`
 	BatteryStatus     string  `json:"battery_status"`
@@ -30,6 +38,87 @@ type HardwareDataRequest struct {
 	PowerUsageWatts   float64 `json:"power_usage_watts"`
 }
 
+func readFirstLineProcStat(ctx context.Context) (string, error) {
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("context error (readFirstLineProcStat): %w", ctx.Err())
+	}
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return "", fmt.Errorf("Error opening file '/proc/stat': %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("error reading /proc/stat: %w", err)
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+func processProcStat(ctx context.Context) (totalActiveCPUTime int64, totalCPUTime int64, err error) {
+	if ctx.Err() != nil {
+		return 0, 0, fmt.Errorf("context error (processProcStat): %w", ctx.Err())
+	}
+	firstLine, err := readFirstLineProcStat(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading /proc/stat (processProcStat): %w", err)
+	}
+
+	if !strings.HasPrefix(firstLine, "cpu ") {
+		return 0, 0, fmt.Errorf("aggregate CPU line missing from /proc/stat")
+	}
+
+	// The space after cpu is important, matches only first aggregated row
+
+	cols := strings.Fields(firstLine)
+	if len(cols) < 11 {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat CPU field count: %d", len(cols))
+	}
+	user, _ := strconv.ParseInt(cols[1], 10, 64)
+	nice, _ := strconv.ParseInt(cols[2], 10, 64)
+	system, _ := strconv.ParseInt(cols[3], 10, 64)
+	idle, _ := strconv.ParseInt(cols[4], 10, 64)
+	iowait, _ := strconv.ParseInt(cols[5], 10, 64)
+	irq, _ := strconv.ParseInt(cols[6], 10, 64)
+	softirq, _ := strconv.ParseInt(cols[7], 10, 64)
+	steal, _ := strconv.ParseInt(cols[8], 10, 64)
+	guest, _ := strconv.ParseInt(cols[9], 10, 64)
+	guest_nice, _ := strconv.ParseInt(cols[10], 10, 64)
+	totalCPUTime = user + nice + system + idle + iowait + irq + softirq + steal + guest + guest_nice
+	idleTime := idle + iowait
+	totalActiveCPUTime = totalCPUTime - idleTime
+	return totalActiveCPUTime, totalCPUTime, nil
+}
+
+// GetCPUUsage returns the CPU usage percent over one second
+func GetCPUUsage(ctx context.Context) (cpuUsagePcnt float64, err error) {
+	active1, total1, err := processProcStat(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error processing first read of /proc/stat: %w", err)
+	}
+	timer := time.NewTimer(1 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, fmt.Errorf("context error (GetCPUUsage): %w", ctx.Err())
+	case <-timer.C:
+		// continue
+	}
+	active2, total2, err := processProcStat(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error processing second read of /proc/stat: %w", err)
+	}
+	activeDelta := float64(active2) - float64(active1)
+	totalDelta := float64(total2) - float64(total1)
+	if activeDelta <= 0 || totalDelta <= 0 {
+		// The CPU can be close to 0% usage on a computer that's not doing anything. Just return 0 without error.
+		return 0, nil
+	}
+	return (activeDelta / totalDelta) * 100, nil
+}
+
 func GetCPUData(rootCtx context.Context) (cpuUsagePcnt float64, cpuMHzAvg float64, cpuTemp float64, err error) {
 	ctx, ctxCancel := context.WithCancel(rootCtx)
 	defer ctxCancel()
@@ -46,90 +135,14 @@ func GetCPUData(rootCtx context.Context) (cpuUsagePcnt float64, cpuMHzAvg float6
 		})
 	}
 
-	readFirstLineProcStat := func(ctx context.Context) (string, error) {
-		if ctx.Err() != nil {
-			return "", fmt.Errorf("context error (GetCPUData/readFirstLineProcStat): %w", ctx.Err())
-		}
-		f, err := os.Open("/proc/stat")
-		if err != nil {
-			return "", fmt.Errorf("Error opening file '/proc/stat': %w", err)
-		}
-		defer f.Close()
-
-		reader := bufio.NewReader(f)
-		line, err := reader.ReadString('\n')
-		if err != nil && !errors.Is(err, io.EOF) {
-			return "", fmt.Errorf("error reading /proc/stat: %w", err)
-		}
-
-		return strings.TrimSpace(line), nil
-	}
-
-	processProcStat := func(ctx context.Context) (totalActiveCPUTime int64, totalCPUTime int64, err error) {
-		if ctx.Err() != nil {
-			return 0, 0, fmt.Errorf("context error (GetCPUData/processProcStat): %w", ctx.Err())
-		}
-		firstLine, err := readFirstLineProcStat(ctx)
-		if err != nil {
-			return 0, 0, fmt.Errorf("error reading /proc/stat (GetCPUData/processProcStat): %w", err)
-		}
-
-		if !strings.HasPrefix(firstLine, "cpu ") {
-			return 0, 0, fmt.Errorf("aggregate CPU line missing from /proc/stat")
-		}
-
-		// The space after cpu is important, matches only first aggregated row
-
-		cols := strings.Fields(firstLine)
-		if len(cols) < 11 {
-			return 0, 0, fmt.Errorf("unexpected /proc/stat CPU field count: %d", len(cols))
-		}
-		user, _ := strconv.ParseInt(cols[1], 10, 64)
-		nice, _ := strconv.ParseInt(cols[2], 10, 64)
-		system, _ := strconv.ParseInt(cols[3], 10, 64)
-		idle, _ := strconv.ParseInt(cols[4], 10, 64)
-		iowait, _ := strconv.ParseInt(cols[5], 10, 64)
-		irq, _ := strconv.ParseInt(cols[6], 10, 64)
-		softirq, _ := strconv.ParseInt(cols[7], 10, 64)
-		steal, _ := strconv.ParseInt(cols[8], 10, 64)
-		guest, _ := strconv.ParseInt(cols[9], 10, 64)
-		guest_nice, _ := strconv.ParseInt(cols[10], 10, 64)
-		totalCPUTime = user + nice + system + idle + iowait + irq + softirq + steal + guest + guest_nice
-		idleTime := idle + iowait
-		totalActiveCPUTime = totalCPUTime - idleTime
-		return totalActiveCPUTime, totalCPUTime, nil
-	}
-
 	// CPU usage percent
 	wg.Go(func() {
-		active1, total1, err := processProcStat(ctx)
+		usage, err := GetCPUUsage(ctx)
 		if err != nil {
-			sendToErrChanOnce(fmt.Errorf("error processing first read of /proc/stat: %w", err))
-			return
-		}
-		timer := time.NewTimer(1 * time.Second)
-		defer timer.Stop()
-		select {
-		case <-ctx.Done():
-			sendToErrChanOnce(fmt.Errorf("context error (GetCPUData - CPU Usage): %w", ctx.Err()))
-			return
-		case <-timer.C:
-			// continue
-		}
-		active2, total2, err := processProcStat(ctx)
-		if err != nil {
-			sendToErrChanOnce(fmt.Errorf("error processing second read of /proc/stat: %w", err))
-			return
-		}
-		activeDelta := float64(active2) - float64(active1)
-		totalDelta := float64(total2) - float64(total1)
-		if activeDelta == totalDelta || activeDelta == 0 || totalDelta == 0 {
-			// The CPU can be close to 0% usage on a computer that's not doing anything. Just return 0 without error.
-			// sendToErrChanOnce(fmt.Errorf("arithmetic error between active and total CPU time deltas"))
+			sendToErrChanOnce(err)
 			return
 		}
-
-		cpuUsagePcnt = (activeDelta / totalDelta) * 100
+		cpuUsagePcnt = usage
 	})
 
 	// CPU MHz
@@ -302,6 +315,8 @@ func GetMemoryData() (totalCapacityKB int64, totalUsageKB int64, err error) {
 	return totalCapacityKB, totalUsageKB, nil
 }
 
+// GetPowerSupplyData returns the system power draw and the battery charge and
+// status. Without powercap the wattage is 0 and the battery fields are still set.
 func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batChargePcnt int64, batStatus string, err error) {
 	ctx, ctxCancel := context.WithCancel(rootCtx)
 	defer ctxCancel()
@@ -323,9 +338,13 @@ func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batCh
 		var totaluJoules int64
 
 		powercapDirs, err := os.ReadDir(powercapRootDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, ErrNoPowercap
+		}
 		if err != nil {
 			return 0, fmt.Errorf("cannot open root powercap directory: %w", err)
 		}
+		counters := 0
 
 		for _, dir := range powercapDirs {
 			if ctx.Err() != nil {
@@ -342,10 +361,14 @@ func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batCh
 			f, err1 = os.Open(powercapFile)
 			if err1 != nil {
 				f, err2 = os.Open(powercapFileFallback)
+				if errors.Is(err1, fs.ErrNotExist) && errors.Is(err2, fs.ErrNotExist) {
+					continue
+				}
 				if err2 != nil {
 					return 0, fmt.Errorf("cannot read '%s' (%w) or '%s' (%w)", powercapFile, err1, powercapFileFallback, err2)
 				}
 			}
+			counters++
 
 			scanner := bufio.NewScanner(f)
 
@@ -353,15 +376,21 @@ func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batCh
 				line := strings.TrimSpace(scanner.Text())
 				joules, err := strconv.ParseInt(line, 10, 64)
 				if err != nil {
+					f.Close()
 					return 0, fmt.Errorf("unable to parse total microjoules value: %w", err)
 				}
 				totaluJoules += joules
 
 			}
-			if err := scanner.Err(); err != nil {
+			err := scanner.Err()
+			f.Close()
+			if err != nil {
 				return 0, (fmt.Errorf("error reading powercap file: %w", err))
 			}
 		}
+		if counters == 0 {
+			return 0, ErrNoPowercap
+		}
 		if totaluJoules == 0 {
 			return 0, fmt.Errorf("aggregate microjoule value is zero")
 		}
@@ -371,6 +400,9 @@ func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batCh
 	// Current wattage
 	wg.Go(func() {
 		totalWatts1, err := getTotalWatts(ctx)
+		if errors.Is(err, ErrNoPowercap) {
+			return
+		}
 		if err != nil {
 			sendToErrChanOnce(fmt.Errorf("error during wattage reading: %w", err))
 			return
@@ -394,36 +426,10 @@ func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batCh
 
 	// Battery charge percent and status string
 	wg.Go(func() {
-		hwmonDirs, err := os.ReadDir(hwmonDirRoot)
+		var err error
+		batChargePcnt, batStatus, _, err = GetBatteryData(ctx)
 		if err != nil {
-			sendToErrChanOnce(fmt.Errorf("error opening directory '%s': %w", hwmonDirRoot, err))
-			return
-		}
-		for _, dir := range hwmonDirs {
-			if ctx.Err() != nil {
-				sendToErrChanOnce(fmt.Errorf("context error (GetPowerSupplyData - Bat charge & status): %w", ctx.Err()))
-				return
-			}
-			hwmonDir := filepath.Join(hwmonDirRoot, dir.Name())
-			deviceNameBytes, _ := os.ReadFile(filepath.Join(hwmonDir, "name"))
-			deviceName := strings.TrimSpace(string(deviceNameBytes))
-			if deviceName != "BAT0" && deviceName != "BAT1" {
-				continue
-			}
-			chargePcntBytes, err := os.ReadFile(filepath.Join(hwmonDir, "device", "capacity"))
-			if err != nil {
-				sendToErrChanOnce(fmt.Errorf("cannot read file '%s': %w", filepath.Join(hwmonDir, "device", "capacity"), err))
-				return
-			}
-			chargePcntStr := strings.TrimSpace(string(chargePcntBytes))
-			batChargePcnt, err = strconv.ParseInt(chargePcntStr, 10, 64)
-			if err != nil {
-				sendToErrChanOnce(fmt.Errorf("cannot parse battery charge percent: %w", err))
-				return
-			}
-
-			statusBytes, _ := os.ReadFile(filepath.Join(hwmonDir, "device", "status"))
-			batStatus = strings.TrimSpace(string(statusBytes))
+			sendToErrChanOnce(err)
 		}
 	})
 
@@ -436,11 +442,46 @@ func GetPowerSupplyData(rootCtx context.Context) (powerUsageWatts float64, batCh
 	return powerUsageWatts, batChargePcnt, batStatus, nil
 }
 
+// GetBatteryData reads the charge percent and status of the first battery.
+// found is false on systems without a battery.
+func GetBatteryData(ctx context.Context) (chargePcnt int64, status string, found bool, err error) {
+	hwmonDirs, err := os.ReadDir(hwmonDirRoot)
+	if err != nil {
+		return 0, "", false, fmt.Errorf("error opening directory '%s': %w", hwmonDirRoot, err)
+	}
+	for _, dir := range hwmonDirs {
+		if ctx.Err() != nil {
+			return 0, "", false, fmt.Errorf("context error (GetBatteryData): %w", ctx.Err())
+		}
+		hwmonDir := filepath.Join(hwmonDirRoot, dir.Name())
+		deviceNameBytes, _ := os.ReadFile(filepath.Join(hwmonDir, "name"))
+		deviceName := strings.TrimSpace(string(deviceNameBytes))
+		if deviceName != "BAT0" && deviceName != "BAT1" {
+			continue
+		}
+		chargePcntBytes, err := os.ReadFile(filepath.Join(hwmonDir, "device", "capacity"))
+		if err != nil {
+			return 0, "", false, fmt.Errorf("cannot read file '%s': %w", filepath.Join(hwmonDir, "device", "capacity"), err)
+		}
+		chargePcnt, err = strconv.ParseInt(strings.TrimSpace(string(chargePcntBytes)), 10, 64)
+		if err != nil {
+			return 0, "", false, fmt.Errorf("cannot parse battery charge percent: %w", err)
+		}
+
+		statusBytes, _ := os.ReadFile(filepath.Join(hwmonDir, "device", "status"))
+		return chargePcnt, strings.TrimSpace(string(statusBytes)), true, nil
+	}
+	return 0, "", false, nil
+}
+
+// GetDiskData returns the hottest NVMe temperature sensor and its max
+// temperature in degrees C. Returns ErrNoDiskSensor if there is no NVMe disk.
 func GetDiskData() (curTemp float64, maxTemp float64, err error) {
 	hwmonDirs, err := os.ReadDir(hwmonDirRoot)
 	if err != nil {
 		return 0, 0, fmt.Errorf("error opening directory '%s': %w", hwmonDirRoot, err)
 	}
+	found := false
 	for _, dir := range hwmonDirs {
 		hwmonDir := filepath.Join(hwmonDirRoot, dir.Name())
 		hwmonNameBytes, _ := os.ReadFile(filepath.Join(hwmonDir, "name"))
@@ -449,25 +490,39 @@ func GetDiskData() (curTemp float64, maxTemp float64, err error) {
 			continue
 		}
 
-		// TODO: loop over temp*_input and temp1*_max
-		curTempBytes, _ := os.ReadFile(filepath.Join(hwmonDir, "temp1_input"))
-		curTempStr := strings.TrimSpace(string(curTempBytes))
-		cur, err := strconv.ParseInt(curTempStr, 10, 64)
+		inputs, err := filepath.Glob(filepath.Join(hwmonDir, "temp*_input"))
 		if err != nil {
-			return 0, 0, fmt.Errorf("cannot parse current disk temp: %w", err)
+			return 0, 0, fmt.Errorf("cannot list temp sensors in '%s': %w", hwmonDir, err)
 		}
-		curTemp = float64(cur) / 1000
+		for _, input := range inputs {
+			curTempBytes, err := os.ReadFile(input)
+			if err != nil {
+				continue // some sensors cannot be read while the disk is in a low power state
+			}
+			cur, err := strconv.ParseInt(strings.TrimSpace(string(curTempBytes)), 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("cannot parse disk temp '%s': %w", input, err)
+			}
+			if found && float64(cur)/1000 <= curTemp {
+				continue
+			}
+			found = true
+			curTemp = float64(cur) / 1000
 
-		maxTempBytes, err := os.ReadFile(filepath.Join(hwmonDir, "temp1_max"))
-		if err != nil {
-			return 0, 0, fmt.Errorf("cannot read file '%s': %w", filepath.Join(hwmonDir, "temp1_max"), err)
-		}
-		maxTempStr := strings.TrimSpace(string(maxTempBytes))
-		max, err := strconv.ParseInt(maxTempStr, 10, 64)
-		if err != nil {
-			return 0, 0, fmt.Errorf("cannot parse max disk temp: %w", err)
+			// temp2_input goes with temp2_max
+			maxTemp = 0
+			maxTempPath := strings.TrimSuffix(input, "_input") + "_max"
+			if maxTempBytes, err := os.ReadFile(maxTempPath); err == nil {
+				max, err := strconv.ParseInt(strings.TrimSpace(string(maxTempBytes)), 10, 64)
+				if err != nil {
+					return 0, 0, fmt.Errorf("cannot parse max disk temp '%s': %w", maxTempPath, err)
+				}
+				maxTemp = float64(max) / 1000
+			}
 		}
-		maxTemp = float64(max) / 1000
+	}
+	if !found {
+		return 0, 0, ErrNoDiskSensor
 	}
 	return curTemp, maxTemp, nil
 }
@@ -651,32 +706,26 @@ func GetNetworkData(rootCtx context.Context) (linkSpeed int64, kbpsThroughput fl
 	return linkSpeed, kbpsThroughput, nil
 }
 
-func printHardwareData() {
-	parentCtx, ctxCancel := context.WithCancel(context.Background())
-	defer ctxCancel()
+// CollectHardwareData samples CPU, memory, power supply, disk and network data
+// in parallel, which takes about a second. A failing source does not stop the
+// others, the data that could be read is returned along with the joined errors.
+func CollectHardwareData(ctx context.Context) (*HardwareDataRequest, error) {
 	var wg sync.WaitGroup
-	errChan := make(chan error, 5) // CPU, memory, power, disk, network
-	sendToErrChan := func(err error) {
-		if err != nil {
-			select {
-			case errChan <- err:
-				ctxCancel()
-			default:
-				// Do not block goroutines, channel drained after wg.Wait(),
-				// so use Fprintf as a fallback in case errChan's buffer is full
-				fmt.Fprintf(os.Stderr, "[Error] hardware data error: %v\n", err)
-				ctxCancel()
-			}
-		}
+	var errsMu sync.Mutex
+	var errs []error
+	addErr := func(err error) {
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		errs = append(errs, err)
 	}
 
 	hardwareData := new(HardwareDataRequest)
 
 	// CPU data
 	wg.Go(func() {
-		cpuUsage, cpuMHz, cpuTemp, err := GetCPUData(parentCtx)
+		cpuUsage, cpuMHz, cpuTemp, err := GetCPUData(ctx)
 		if err != nil {
-			sendToErrChan(fmt.Errorf("error retrieving CPU data: %w", err))
+			addErr(fmt.Errorf("error retrieving CPU data: %w", err))
 			return
 		}
 		hardwareData.CPUUsagePcnt = cpuUsage
@@ -688,7 +737,7 @@ func printHardwareData() {
 	wg.Go(func() {
 		memCapacity, memUsage, err := GetMemoryData()
 		if err != nil {
-			sendToErrChan(fmt.Errorf("error retrieving memory data: %w", err))
+			addErr(fmt.Errorf("error retrieving memory data: %w", err))
 			return
 		}
 		hardwareData.MemCapacityKB = memCapacity
@@ -697,9 +746,9 @@ func printHardwareData() {
 
 	// Power supply and battery data
 	wg.Go(func() {
-		powerUsage, batCharge, batStatus, err := GetPowerSupplyData(parentCtx)
+		powerUsage, batCharge, batStatus, err := GetPowerSupplyData(ctx)
 		if err != nil {
-			sendToErrChan(fmt.Errorf("error retrieving battery data: %w", err))
+			addErr(fmt.Errorf("error retrieving battery data: %w", err))
 			return
 		}
 		hardwareData.PowerUsageWatts = powerUsage
@@ -710,8 +759,11 @@ func printHardwareData() {
 	// Disk data
 	wg.Go(func() {
 		diskTemp, diskMaxTemp, err := GetDiskData()
+		if errors.Is(err, ErrNoDiskSensor) {
+			return
+		}
 		if err != nil {
-			sendToErrChan(fmt.Errorf("error retrieving disk data: %w", err))
+			addErr(fmt.Errorf("error retrieving disk data: %w", err))
 			return
 		}
 		hardwareData.DiskTemp = diskTemp
@@ -720,9 +772,9 @@ func printHardwareData() {
 
 	// Network data
 	wg.Go(func() {
-		netLinkSpeed, netThroughput, err := GetNetworkData(parentCtx)
+		netLinkSpeed, netThroughput, err := GetNetworkData(ctx)
 		if err != nil {
-			sendToErrChan(fmt.Errorf("error retrieving net interface data: %w\n", err))
+			addErr(fmt.Errorf("error retrieving net interface data: %w", err))
 			return
 		}
 		hardwareData.NetLinkSpeedKbit = netLinkSpeed * 1000 // By default this unit is in mbit, converting to kbit for consistency
@@ -730,11 +782,6 @@ func printHardwareData() {
 	})
 
 	wg.Wait()
-	close(errChan)
-
-	for err := range errChan {
-		fmt.Fprintf(os.Stderr, "[Error] hardware data error: %v", err)
-	}
 
-	fmt.Printf("data: \n%#v\n", hardwareData)
+	return hardwareData, errors.Join(errs...)
 }
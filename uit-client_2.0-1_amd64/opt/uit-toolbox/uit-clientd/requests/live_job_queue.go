@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
-	"strconv"
 	"sync"
 )
 
@@ -20,6 +19,8 @@ type ClientJobQueueDataResponse struct {
 	NameFormatted string `json:"name_formatted"`
 	QueuePosition *int64 `json:"queue_position"`
 	Status        string `json:"status"`
+	// Whether anyone has the live view of this client open, nil if the server does not say
+	LiveViewActive *bool `json:"live_view_active,omitempty"`
 }
 
 var (
@@ -27,11 +28,11 @@ var (
 	jobQueueDataBufMu sync.Mutex
 )
 
-func GetJobQueueData(ctx context.Context, tag int64) (ClientJobQueueDataResponse, error) {
+// GetJobQueueData polls the job of the client, by serial until it has a tag
+func GetJobQueueData(ctx context.Context, tag int64, serial string) (ClientJobQueueDataResponse, error) {
 	jq := ClientJobQueueDataResponse{}
 
-	q := url.Values{}
-	q.Set("tagnumber", strconv.FormatInt(tag, 10))
+	q := ClientQuery(tag, serial)
 
 	jobQueueDataBufMu.Lock()
 	defer jobQueueDataBufMu.Unlock()
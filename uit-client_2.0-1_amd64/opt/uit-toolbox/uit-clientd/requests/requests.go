@@ -2,51 +2,117 @@ package requests
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/retry"
 )
 
+// ErrNotFound is returned when the server responds with 404
+var ErrNotFound = errors.New("not found on server")
+
 var (
-	client *http.Client
-	tr     *http.Transport
+	client         *http.Client
+	tr             *http.Transport
+	initClientOnce sync.Once
+	serverURL      atomic.Pointer[url.URL]
 )
 
-func initRequests() error {
-	tr = &http.Transport{
-		MaxIdleConns:    10,
-		IdleConnTimeout: 30 * time.Second,
+func initRequests() {
+	initClientOnce.Do(func() {
+		tr = &http.Transport{
+			MaxIdleConns:    10,
+			IdleConnTimeout: 30 * time.Second,
+		}
+		client = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: tr,
+		}
+	})
+}
+
+// SetServerURL sets the scheme and host that every request is sent to.
+func SetServerURL(u url.URL) {
+	serverURL.Store(&url.URL{Scheme: u.Scheme, Host: u.Host})
+}
+
+// ServerURL returns the scheme and host set by SetServerURL.
+func ServerURL() (url.URL, error) {
+	u := serverURL.Load()
+	if u == nil || u.Host == "" {
+		return url.URL{}, fmt.Errorf("server URL is not set")
 	}
-	client = &http.Client{
-		Transport: tr,
+	return *u, nil
+}
+
+// ClientQuery identifies a client in a query string: by tag number once it has
+// one, by serial while enrollment is still waiting for a tag
+func ClientQuery(tag int64, serial string) url.Values {
+	q := url.Values{}
+	if tag != 0 {
+		q.Set("tagnumber", strconv.FormatInt(tag, 10))
+	} else {
+		q.Set("system_serial", serial)
 	}
-	return nil
+	return q
 }
 
-func constructURL(u url.URL) url.URL {
+func constructURL(u url.URL) (url.URL, error) {
+	base, err := ServerURL()
+	if err != nil {
+		return url.URL{}, err
+	}
 	return url.URL{
-		Scheme:   "https",
-		Host:     "10.0.0.1:31411",
+		Scheme:   base.Scheme,
+		Host:     base.Host,
 		Path:     u.Path,
 		RawQuery: u.RawQuery,
+	}, nil
+}
+
+// Every request to the server at debug level, with how long the server took
+// to answer
+func logResponse(req *http.Request, resp *http.Response, err error, latency time.Duration) {
+	log := logging.Component("requests").With("method", req.Method, "path", req.URL.Path, logging.Latency(latency))
+	if err != nil {
+		log.Debug("request failed", "error", err)
+		return
 	}
+	log.Debug("response", "status", resp.StatusCode)
 }
 
+// Non-2xx responses are returned as *retry.StatusError, 404 also matches ErrNotFound
 func getRequest(ctx context.Context, u url.URL, w io.Writer) error {
-	if client == nil || tr == nil {
-		if err := initRequests(); err != nil {
-			return err
-		}
+	initRequests()
+	merged, err := constructURL(u)
+	if err != nil {
+		return err
 	}
-	merged := constructURL(u)
 
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
-	resp, err := client.Get(merged.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, merged.String(), nil)
+	if err != nil {
+		return fmt.Errorf("cannot create GET request for '%s': %w", merged.String(), err)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	logResponse(req, resp, err, time.Since(start))
+	if resp != nil {
+		RecordServerResponse(req.Method, resp.StatusCode, time.Since(start), nil)
+	} else {
+		RecordServerResponse(req.Method, 0, time.Since(start), err)
+	}
 	if err != nil {
 		if resp != nil {
 			return fmt.Errorf("error GETing request from '%s' (%d): %w", merged.String(), resp.StatusCode, err)
@@ -55,6 +121,13 @@ func getRequest(ctx context.Context, u url.URL, w io.Writer) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", ErrNotFound, retry.NewStatusError(resp))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return retry.NewStatusError(resp)
+	}
+
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
 		return err
@@ -63,17 +136,34 @@ func getRequest(ctx context.Context, u url.URL, w io.Writer) error {
 	return nil
 }
 
+// Non-2xx responses are returned as *retry.StatusError
 func postRequest(ctx context.Context, u url.URL, contentType string, body io.Reader) error {
-	if client == nil || tr == nil {
-		initRequests()
+	initRequests()
+	merged, err := constructURL(u)
+	if err != nil {
+		return err
 	}
-	merged := constructURL(u)
 
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
-	resp, err := client.Post(merged.String(), contentType, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, merged.String(), body)
+	if err != nil {
+		return fmt.Errorf("cannot create POST request for '%s': %w", merged.String(), err)
+	}
+	if req.Body != http.NoBody && req.ContentLength == 0 {
+		req.ContentLength = -1 // streamed body, size unknown until the end
+	}
+	req.Header.Set("Content-Type", contentType)
+	start := time.Now()
+	resp, err := client.Do(req)
+	logResponse(req, resp, err, time.Since(start))
+	if resp != nil {
+		RecordServerResponse(req.Method, resp.StatusCode, time.Since(start), nil)
+	} else {
+		RecordServerResponse(req.Method, 0, time.Since(start), err)
+	}
 	if err != nil {
 		if resp != nil {
 			return fmt.Errorf("error POSTing request to '%s' (%d): %w", merged.String(), resp.StatusCode, err)
@@ -83,7 +173,7 @@ func postRequest(ctx context.Context, u url.URL, contentType string, body io.Rea
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("response from '%s' returned non-200 value %d (POST)", merged.String(), resp.StatusCode)
+		return retry.NewStatusError(resp)
 	}
 
 	return nil
@@ -0,0 +1,362 @@
+//go:build linux && amd64
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"uit-clientd/logging"
+)
+
+// Policy describes how an operation is retried. Zero values fall back to
+// the defaults noted on each field.
+type Policy struct {
+	Name            string        // shows up in logs and stats
+	InitialInterval time.Duration // default 1s
+	MaxInterval     time.Duration // default 1m
+	Multiplier      float64       // default 2
+	Jitter          float64       // up to 1, fraction of each delay that is randomized, default 0.2, negative disables
+	MaxElapsed      time.Duration // 0 means no limit
+	MaxAttempts     int           // 0 means no limit
+	// Classify reports whether err is worth retrying, default IsRetryable
+	Classify func(err error) bool
+}
+
+// StatusError is a non-2xx HTTP response
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header, 0 if missing
+}
+
+func (e *StatusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s '%s' returned HTTP %d (retry after %s)", e.Method, e.URL, e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("%s '%s' returned HTTP %d", e.Method, e.URL, e.StatusCode)
+}
+
+// NewStatusError builds a StatusError from a response, including its Retry-After header
+func NewStatusError(resp *http.Response) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		if resp.Request.URL != nil {
+			e.URL = resp.Request.URL.String()
+		}
+	}
+	e.RetryAfter = ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return e
+}
+
+// ParseRetryAfter parses delay-seconds or an HTTP date, returns 0 if invalid
+func ParseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not retryable, regardless of the policy
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsRetryable is the default classification: dial errors, timeouts, dropped
+// connections, HTTP 408, 429 and 5xx are retryable. Everything else is not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true // the network may simply not be up yet
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// Server closed the connection before responding
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && errors.Is(urlErr.Err, io.EOF) {
+		return true
+	}
+	return false
+}
+
+// IsRetryableUnsent is the classification for requests that must not reach the
+// server twice, like POSTs: only errors that show the server never acted on
+// the request are retryable. That is a failed dial, a 429, or a 503 with
+// Retry-After. A timeout or dropped connection after the request was written
+// may mean the server already has it.
+func IsRetryableUnsent(err error) bool {
+	if err == nil {
+		return false
+	}
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests ||
+			(statusErr.StatusCode == http.StatusServiceUnavailable && statusErr.RetryAfter > 0)
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// Stats are counters per policy name
+type Stats struct {
+	Attempts  int64 `json:"attempts"`
+	Successes int64 `json:"successes"`
+	Retries   int64 `json:"retries"`
+	GiveUps   int64 `json:"give_ups"`
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[string]*Stats)
+)
+
+func record(name string, update func(s *Stats)) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	s, ok := stats[name]
+	if !ok {
+		s = &Stats{}
+		stats[name] = s
+	}
+	update(s)
+}
+
+// Snapshot returns a copy of the counters of every policy used so far
+func Snapshot() map[string]Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	out := make(map[string]Stats, len(stats))
+	for name, s := range stats {
+		out[name] = *s
+	}
+	return out
+}
+
+// Backoff tracks the attempts of one operation under a policy.
+// It is for loops that cannot be wrapped in Do, it is not safe for concurrent use.
+type Backoff struct {
+	policy   Policy
+	attempt  int
+	start    time.Time
+	interval time.Duration
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.Name == "" {
+		p.Name = "unnamed"
+	}
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = time.Second
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = time.Minute
+	}
+	if p.MaxInterval < p.InitialInterval {
+		p.MaxInterval = p.InitialInterval
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = 0.2
+	case p.Jitter < 0: // explicitly disabled
+		p.Jitter = 0
+	case p.Jitter > 1:
+		p.Jitter = 1
+	}
+	if p.Classify == nil {
+		p.Classify = IsRetryable
+	}
+	return p
+}
+
+// NewBackoff starts tracking a new operation
+func (p Policy) NewBackoff() *Backoff {
+	p = p.withDefaults()
+	return &Backoff{policy: p, interval: p.InitialInterval}
+}
+
+// Next records a failed attempt and returns how long to wait before the next one.
+// ok is false when err is not retryable or a limit of the policy is reached.
+func (b *Backoff) Next(err error) (delay time.Duration, ok bool) {
+	p := b.policy
+	if b.attempt == 0 {
+		b.start = time.Now()
+	}
+	b.attempt++
+	record(p.Name, func(s *Stats) { s.Attempts++ })
+
+	giveUp := func(reason string) (time.Duration, bool) {
+		record(p.Name, func(s *Stats) { s.GiveUps++ })
+		logging.Component("retry").Error("giving up", "policy", p.Name, "attempt", b.attempt, "reason", reason, "error", err)
+		return 0, false
+	}
+
+	if !p.Classify(err) {
+		return giveUp("error is not retryable")
+	}
+	if p.MaxAttempts > 0 && b.attempt >= p.MaxAttempts {
+		return giveUp("max attempts reached")
+	}
+
+	delay = b.interval
+	if p.Jitter > 0 {
+		spread := float64(delay) * p.Jitter
+		delay = time.Duration(float64(delay) - spread + rand.Float64()*2*spread)
+	}
+	// The server knows better than our backoff
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+	if p.MaxElapsed > 0 && time.Since(b.start)+delay > p.MaxElapsed {
+		return giveUp(fmt.Sprintf("max elapsed time %s reached", p.MaxElapsed))
+	}
+
+	b.interval = min(time.Duration(float64(b.interval)*p.Multiplier), p.MaxInterval)
+	record(p.Name, func(s *Stats) { s.Retries++ })
+	logging.Component("retry").Warn("attempt failed, retrying", "policy", p.Name, "attempt", b.attempt, "delay", delay.Round(time.Millisecond).String(), "error", err)
+	return delay, true
+}
+
+// Delay is Next for loops that keep going whatever the error. Once Next gives
+// up, the loop waits MaxInterval and the backoff starts over.
+func (b *Backoff) Delay(err error) time.Duration {
+	if delay, ok := b.Next(err); ok {
+		return delay
+	}
+	b.Reset()
+	return b.policy.MaxInterval
+}
+
+// Success records a successful attempt and resets the backoff
+func (b *Backoff) Success() {
+	record(b.policy.Name, func(s *Stats) {
+		s.Attempts++
+		s.Successes++
+	})
+	b.Reset()
+}
+
+// Reset starts over from the initial interval, without recording anything
+func (b *Backoff) Reset() {
+	b.attempt = 0
+	b.interval = b.policy.InitialInterval
+}
+
+// Attempts returns the failed attempts since the last reset
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Do runs op until it succeeds, returns a non-retryable error, a limit of
+// the policy is reached or ctx is done. The last error is returned.
+func Do(ctx context.Context, p Policy, op func(ctx context.Context) error) error {
+	b := p.NewBackoff()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := op(ctx)
+		if err == nil {
+			b.Success()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		delay, ok := b.Next(err)
+		if !ok {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
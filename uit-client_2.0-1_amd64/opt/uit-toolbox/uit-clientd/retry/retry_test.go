@@ -0,0 +1,209 @@
+//go:build linux && amd64
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{" 7 ", 7 * time.Second},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+var errRetryable = &StatusError{StatusCode: http.StatusServiceUnavailable}
+
+func TestBackoffGrowsToMaxInterval(t *testing.T) {
+	b := Policy{
+		Name:            "test_growth",
+		InitialInterval: time.Second,
+		MaxInterval:     5 * time.Second,
+		Jitter:          -1,
+	}.NewBackoff()
+
+	want := []time.Duration{1, 2, 4, 5, 5}
+	for i, w := range want {
+		delay, ok := b.Next(errRetryable)
+		if !ok {
+			t.Fatalf("attempt %d: gave up", i+1)
+		}
+		if delay != w*time.Second {
+			t.Errorf("attempt %d: delay %s, want %s", i+1, delay, w*time.Second)
+		}
+	}
+
+	b.Success()
+	if delay, _ := b.Next(errRetryable); delay != time.Second {
+		t.Errorf("after Success: delay %s, want %s", delay, time.Second)
+	}
+}
+
+func TestBackoffJitterStaysInRange(t *testing.T) {
+	b := Policy{
+		Name:            "test_jitter",
+		InitialInterval: time.Second,
+		MaxInterval:     time.Second,
+		Jitter:          0.5,
+	}.NewBackoff()
+	for range 200 {
+		delay, ok := b.Next(errRetryable)
+		if !ok {
+			t.Fatal("gave up")
+		}
+		if delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Fatalf("delay %s outside 500ms..1.5s", delay)
+		}
+	}
+}
+
+func TestBackoffHonorsRetryAfter(t *testing.T) {
+	b := Policy{Name: "test_retry_after", InitialInterval: time.Second, Jitter: -1}.NewBackoff()
+	err := &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 30 * time.Second}
+	if delay, ok := b.Next(err); !ok || delay != 30*time.Second {
+		t.Errorf("Next = %s, %v, want 30s, true", delay, ok)
+	}
+	// A Retry-After shorter than the backoff does not shorten it
+	err.RetryAfter = time.Millisecond
+	if delay, _ := b.Next(err); delay != 2*time.Second {
+		t.Errorf("Next = %s, want 2s", delay)
+	}
+}
+
+func TestBackoffGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		err      error
+		attempts int // attempts until Next gives up
+	}{
+		{"not retryable", Policy{}, errors.New("bad request"), 1},
+		{"permanent", Policy{}, Permanent(errRetryable), 1},
+		{"max attempts", Policy{MaxAttempts: 3}, errRetryable, 3},
+		{"max elapsed", Policy{MaxElapsed: time.Second, InitialInterval: 2 * time.Second}, errRetryable, 1},
+		{"custom classify", Policy{Classify: func(error) bool { return false }}, errRetryable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.Name = "test_give_up"
+			b := tt.policy.NewBackoff()
+			for i := 1; i <= tt.attempts; i++ {
+				_, ok := b.Next(tt.err)
+				if i < tt.attempts && !ok {
+					t.Fatalf("gave up after %d attempts, want %d", i, tt.attempts)
+				}
+				if i == tt.attempts && ok {
+					t.Fatalf("still retrying after %d attempts", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffDelayWaitsMaxIntervalAfterGivingUp(t *testing.T) {
+	b := Policy{Name: "test_delay", InitialInterval: time.Second, MaxInterval: time.Minute, Jitter: -1}.NewBackoff()
+	if d := b.Delay(errRetryable); d != time.Second {
+		t.Errorf("retryable: Delay = %s, want 1s", d)
+	}
+	if d := b.Delay(errors.New("bad request")); d != time.Minute {
+		t.Errorf("not retryable: Delay = %s, want 1m", d)
+	}
+	if b.Attempts() != 0 {
+		t.Errorf("backoff not reset after giving up: %d attempts", b.Attempts())
+	}
+}
+
+func TestClassification(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: "https://server", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	readErr := &url.Error{Op: "Post", URL: "https://server", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	eofErr := &url.Error{Op: "Post", URL: "https://server", Err: io.EOF}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		unsent    bool
+	}{
+		{"nil", nil, false, false},
+		{"dial", dialErr, true, true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "server"}, true, true},
+		{"reset after write", readErr, true, false},
+		{"eof", eofErr, true, false},
+		{"deadline", context.DeadlineExceeded, true, false},
+		{"canceled", context.Canceled, false, false},
+		{"400", &StatusError{StatusCode: 400}, false, false},
+		{"404", &StatusError{StatusCode: 404}, false, false},
+		{"408", &StatusError{StatusCode: 408}, true, false},
+		{"429", &StatusError{StatusCode: 429}, true, true},
+		{"500", &StatusError{StatusCode: 500}, true, false},
+		{"503", &StatusError{StatusCode: 503}, true, false},
+		{"503 retry after", &StatusError{StatusCode: 503, RetryAfter: time.Second}, true, true},
+		{"wrapped 429", fmt.Errorf("posting: %w", &StatusError{StatusCode: 429}), true, true},
+		{"permanent dial", Permanent(dialErr), false, false},
+		{"other", errors.New("invalid value"), false, false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.retryable {
+			t.Errorf("%s: IsRetryable = %v, want %v", tt.name, got, tt.retryable)
+		}
+		if got := IsRetryableUnsent(tt.err); got != tt.unsent {
+			t.Errorf("%s: IsRetryableUnsent = %v, want %v", tt.name, got, tt.unsent)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{Name: "test_do", InitialInterval: time.Millisecond, MaxInterval: time.Millisecond}
+
+	calls := 0
+	err := Do(context.Background(), policy, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errRetryable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Do = %v after %d calls, want nil after 3", err, calls)
+	}
+
+	calls = 0
+	bad := errors.New("bad request")
+	err = Do(context.Background(), policy, func(context.Context) error {
+		calls++
+		return bad
+	})
+	if !errors.Is(err, bad) || calls != 1 {
+		t.Errorf("Do = %v after %d calls, want bad request after 1", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Do(ctx, policy, func(context.Context) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("Do with canceled context = %v, want context.Canceled", err)
+	}
+}
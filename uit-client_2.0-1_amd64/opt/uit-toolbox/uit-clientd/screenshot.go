@@ -0,0 +1,352 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"uit-clientd/framebuffer"
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+	"uit-clientd/retry"
+)
+
+// Job states that screenshot intervals are configured for
+type screenshotState string
+
+const (
+	screenshotIdle    screenshotState = "idle"
+	screenshotQueued  screenshotState = "queued"
+	screenshotErasing screenshotState = "erasing"
+	screenshotCloning screenshotState = "cloning"
+	screenshotFailed  screenshotState = "failed"
+)
+
+var defaultScreenshotIntervals = map[screenshotState]time.Duration{
+	screenshotIdle:    5 * time.Second,
+	screenshotQueued:  5 * time.Second,
+	screenshotErasing: 3 * time.Second,
+	screenshotCloning: 3 * time.Second,
+	screenshotFailed:  10 * time.Second,
+}
+
+const (
+	// Captures right after the job state changes, so the live view catches up quickly
+	screenshotBurstCount    = 5
+	screenshotBurstInterval = time.Second
+	// How often a paused scheduler checks whether the live view was opened
+	screenshotPauseCheck = 3 * time.Second
+)
+
+func screenshotStateOf(jq *requests.ClientJobQueueDataResponse) screenshotState {
+	if jq == nil {
+		return screenshotIdle
+	}
+	status := strings.ToLower(jq.Status)
+	name := strings.ToLower(jq.Name)
+	switch {
+	case strings.HasPrefix(status, "fail"):
+		return screenshotFailed
+	case jobRunning(jq):
+		// Erase and clone jobs run both, the status says which part is running
+		switch {
+		case strings.Contains(status, "clon"):
+			return screenshotCloning
+		case strings.Contains(status, "eras"):
+			return screenshotErasing
+		case strings.Contains(name, "clone"):
+			return screenshotCloning
+		}
+		return screenshotErasing
+	case jobActive(jq):
+		return screenshotQueued
+	}
+	return screenshotIdle
+}
+
+// Decides when the next screenshot is due from the last polled job state
+type screenshotScheduler struct {
+	name      string // log prefix
+	intervals map[screenshotState]time.Duration
+	state     screenshotState
+	burstLeft int
+	paused    bool
+}
+
+func newScreenshotScheduler(name string, configured map[string]time.Duration) *screenshotScheduler {
+	s := &screenshotScheduler{name: name, intervals: make(map[screenshotState]time.Duration), state: screenshotIdle}
+	for state, d := range defaultScreenshotIntervals {
+		s.intervals[state] = d
+	}
+	for name, d := range configured {
+		if _, ok := defaultScreenshotIntervals[screenshotState(name)]; !ok {
+			logging.Component(s.name).Warn("ignoring interval for unknown job state", "state", name)
+			continue
+		}
+		s.intervals[screenshotState(name)] = d
+	}
+	return s
+}
+
+// Called on every tick, returns whether to capture now and how long to wait
+// for the next tick
+func (s *screenshotScheduler) next(jq *requests.ClientJobQueueDataResponse) (time.Duration, bool) {
+	if state := screenshotStateOf(jq); state != s.state {
+		logging.Component(s.name).Info("job state changed", "from", s.state, "to", state)
+		s.state = state
+		s.burstLeft = screenshotBurstCount
+	}
+
+	paused := liveViewClosed(jq)
+	if paused != s.paused {
+		if paused {
+			logging.Component(s.name).Info("nobody is watching the live view, paused")
+		} else {
+			logging.Component(s.name).Info("live view opened, resumed")
+		}
+		s.paused = paused
+	}
+	if paused {
+		return screenshotPauseCheck, false
+	}
+
+	interval := s.intervals[s.state]
+	if s.burstLeft > 0 {
+		s.burstLeft--
+		interval = min(interval, screenshotBurstInterval)
+	}
+	return interval, true
+}
+
+// Reports whether jq would change what next decides, a new job state or the
+// live view being opened. Other job events leave the current wait alone.
+func (s *screenshotScheduler) changedBy(jq *requests.ClientJobQueueDataResponse) bool {
+	return screenshotStateOf(jq) != s.state || (s.paused && !liveViewClosed(jq))
+}
+
+// The server says nobody is watching, nil means it does not say
+func liveViewClosed(jq *requests.ClientJobQueueDataResponse) bool {
+	return jq != nil && jq.LiveViewActive != nil && !*jq.LiveViewActive
+}
+
+// Screenshot encoding, requested by the server through the client config
+type screenshotOptions struct {
+	Format      string // png or jpeg
+	JPEGQuality int
+	MaxWidth    int // 0 for full size
+	KeepAlive   time.Duration
+}
+
+var defaultScreenshotOptions = screenshotOptions{
+	Format:      "png",
+	JPEGQuality: 75,
+	KeepAlive:   time.Minute,
+}
+
+// Invalid fields keep their default and are returned as errors
+func screenshotOptionsFrom(cfg *ClientConfig) (screenshotOptions, error) {
+	opts := defaultScreenshotOptions
+	if cfg == nil {
+		return opts, nil
+	}
+	var errs []error
+	switch format := strings.ToLower(strings.TrimSpace(cfg.UIT_CLIENT_SCREENSHOT_FORMAT)); format {
+	case "":
+	case "png", "jpeg":
+		opts.Format = format
+	case "jpg":
+		opts.Format = "jpeg"
+	default:
+		errs = append(errs, fmt.Errorf("unknown screenshot format '%s'", format))
+	}
+	if v := strings.TrimSpace(cfg.UIT_CLIENT_SCREENSHOT_JPEG_QUALITY); v != "" {
+		if q, err := strconv.Atoi(v); err != nil || q < 1 || q > 100 {
+			errs = append(errs, fmt.Errorf("invalid screenshot JPEG quality '%s', expected 1-100", v))
+		} else {
+			opts.JPEGQuality = q
+		}
+	}
+	if v := strings.TrimSpace(cfg.UIT_CLIENT_SCREENSHOT_MAX_WIDTH); v != "" {
+		if w, err := strconv.Atoi(v); err != nil || w < 0 {
+			errs = append(errs, fmt.Errorf("invalid screenshot max width '%s'", v))
+		} else {
+			opts.MaxWidth = w
+		}
+	}
+	if v := strings.TrimSpace(cfg.UIT_CLIENT_SCREENSHOT_KEEPALIVE); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid screenshot keep-alive '%s'", v))
+		} else {
+			opts.KeepAlive = d
+		}
+	}
+	return opts, errors.Join(errs...)
+}
+
+// Sends framebuffer captures, skipping frames identical to the last one sent
+// until the keep-alive is due
+type screenshotUploader struct {
+	device      string
+	lastHash    uint64
+	lastSent    time.Time
+	lastOptsErr string
+}
+
+func (u *screenshotUploader) options() screenshotOptions {
+	opts, err := screenshotOptionsFrom(clientConfig.Load())
+	if msg := fmt.Sprint(err); err != nil && msg != u.lastOptsErr {
+		logging.Component("screenshot").Warn("invalid screenshot options in client config", "error", err)
+		u.lastOptsErr = msg
+	} else if err == nil {
+		u.lastOptsErr = ""
+	}
+	return opts
+}
+
+// Largest encoded screenshot that is uploaded in format
+func screenshotMaxBytes(format string) int64 {
+	if format != "jpeg" {
+		return screenshotPNGLimits().MaxBytes
+	}
+	if settings := daemonSettings.Load(); settings != nil && settings.ScreenshotJPEGMaxBytes > 0 {
+		return settings.ScreenshotJPEGMaxBytes
+	}
+	return 4 << 20
+}
+
+var errScreenshotTooLarge = errors.New("screenshot is over the size limit")
+
+// Counts the bytes written to w and fails once there would be more than max
+type limitWriter struct {
+	w   io.Writer
+	max int64
+	n   int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n+int64(len(p)) > l.max {
+		return 0, fmt.Errorf("%w of %d bytes", errScreenshotTooLarge, l.max)
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// Captures the framebuffer and sends it unless nothing changed
+func (u *screenshotUploader) take(ctx context.Context, tag int64, serial string) error {
+	img, _, err := framebuffer.Capture(u.device)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	opts := u.options()
+
+	// Same pixels with the same options give the same upload
+	h := fnv.New64a()
+	_, _ = h.Write(img.Pix)
+	fmt.Fprintf(h, "%+v", opts)
+	sum := h.Sum64()
+	if sum == u.lastHash && time.Since(u.lastSent) < opts.KeepAlive {
+		lifecycle.count(func(c *LifecycleCounters) { c.ScreenshotsSkipped++ })
+		return nil
+	}
+
+	scaled := framebuffer.Downscale(img, opts.MaxWidth)
+	contentType := "image/png"
+	encode := func(w io.Writer) error { return framebuffer.EncodePNG(w, scaled) }
+	if opts.Format == "jpeg" {
+		contentType = "image/jpeg"
+		encode = func(w io.Writer) error { return framebuffer.EncodeJPEG(w, scaled, opts.JPEGQuality) }
+	}
+
+	// The encoder writes straight into the request body, the size limit is
+	// enforced as the bytes go through
+	pipeReader, pipeWriter := io.Pipe()
+	limited := &limitWriter{w: pipeWriter, max: screenshotMaxBytes(opts.Format)}
+	encodeErr := make(chan error, 1)
+	go func() {
+		err := encode(limited)
+		_ = pipeWriter.CloseWithError(err)
+		encodeErr <- err
+	}()
+	err = requests.PostLiveScreenshot(ctx, tag, serial, contentType, pipeReader)
+	// Unblocks the encoder if the upload ended before reading everything
+	_ = pipeReader.Close()
+	if err := <-encodeErr; err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return retry.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	u.lastHash, u.lastSent = sum, time.Now()
+	lifecycle.count(func(c *LifecycleCounters) { c.ScreenshotsSent++ })
+	return nil
+}
+
+// Sends screenshots of the framebuffer until ctx is done, on the schedule of
+// the job state from the poll loop. Unchanged frames are skipped. Uploads are
+// keyed by serial until the client has a tag number.
+func runScreenshotLoop(ctx context.Context, device string, intervals map[string]time.Duration) {
+	scheduler := newScreenshotScheduler("screenshot", intervals)
+	uploader := &screenshotUploader{device: device}
+	backoff := retry.Policy{
+		Name:            "screenshot",
+		InitialInterval: scheduler.intervals[screenshotIdle],
+		MaxInterval:     time.Minute,
+	}.NewBackoff()
+	timer := time.NewTimer(scheduler.intervals[screenshotIdle])
+	defer timer.Stop()
+
+	if info, err := framebuffer.ReadInfo(device); err != nil {
+		logging.Component("screenshot").Warn("cannot read framebuffer", "error", err)
+	} else {
+		logging.Component("screenshot").Info("framebuffer found", "device", device, "width", info.Width, "height", info.Height, "format", info.Format.String(), "driver", info.Name)
+	}
+
+	// Job state changes cut the current wait short
+	events, unsubscribe := jobEvents.subscribe()
+	defer func() { unsubscribe() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				events, unsubscribe = jobEvents.subscribe()
+				continue
+			}
+			if scheduler.changedBy(event.Job) {
+				timer.Reset(0)
+			}
+			continue
+		case <-timer.C:
+		}
+
+		serial := systemSerial.Load()
+		if serial == nil {
+			timer.Reset(scheduler.intervals[screenshotIdle])
+			continue // awaiting system identity
+		}
+		delay, capture := scheduler.next(jobQueueData.Load())
+		if !capture {
+			timer.Reset(delay)
+			continue
+		}
+		if err := uploader.take(ctx, tagnumber.Load(), *serial); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			timer.Reset(max(delay, backoff.Delay(err)))
+			continue
+		}
+		backoff.Success()
+		timer.Reset(delay)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"uit-clientd/logging"
+)
+
+var (
+	listenerUp      atomic.Bool
+	notifyReadyOnce sync.Once
+)
+
+// Reports whether a systemd PID variable (LISTEN_PID, WATCHDOG_PID) is meant
+// for this process. An unset variable does not match.
+func systemdPIDMatches(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	pid, err := strconv.Atoi(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return pid == os.Getpid(), nil
+}
+
+// Sends a state to the service manager over $NOTIFY_SOCKET, see sd_notify(3).
+// Does nothing when not started by systemd.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if socketPath[0] == '@' { // abstract namespace
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("cannot connect to NOTIFY_SOCKET: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("cannot write to NOTIFY_SOCKET: %w", err)
+	}
+	return nil
+}
+
+// Returns how often WATCHDOG=1 should be sent, half of WatchdogSec.
+// ok is false when the watchdog is not enabled for this process.
+func sdWatchdogInterval() (interval time.Duration, ok bool) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, false
+	}
+	// WATCHDOG_PID is optional, but if set it must be us
+	if os.Getenv("WATCHDOG_PID") != "" {
+		forUs, err := systemdPIDMatches("WATCHDOG_PID")
+		if err != nil || !forUs {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		logging.Component("systemd").Warn("ignoring invalid WATCHDOG_USEC", "value", usec)
+		return 0, false
+	}
+	return time.Duration(n) * time.Microsecond / 2, true
+}
+
+// Sends READY=1 once the socket listener is up and the first job poll has succeeded
+func notifyReadyIfDone() {
+	if !listenerUp.Load() || !lifecycle.isReady() {
+		return
+	}
+	notifyReadyOnce.Do(func() {
+		if err := sdNotify("READY=1\nSTATUS=" + string(lifecycle.current())); err != nil {
+			logging.Component("systemd").Error("sd_notify failed", "error", err)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/metrics"
+	"uit-clientd/requests"
+	"uit-clientd/retry"
+)
+
+// Builds one live data document from a fresh hardware sample, the last job
+// poll and the app status
+func collectLiveData(ctx context.Context) (*requests.LiveDataRequest, error) {
+	// Keyed by serial alone until enrollment assigns a tag
+	serial := systemSerial.Load()
+	if serial == nil {
+		return nil, fmt.Errorf("no serial yet")
+	}
+	tag := tagnumber.Load()
+
+	// Partial hardware data is still sent, a laptop without powercap
+	// should not lose its CPU and memory data
+	hardware, err := requests.CollectHardwareData(ctx)
+
+	return &requests.LiveDataRequest{
+		Tagnumber:    tag,
+		SystemSerial: *serial,
+		SampledAt:    time.Now(),
+		Hardware:     hardware,
+		Job:          jobQueueData.Load(),
+		Status:       requests.GetAppStatus(string(lifecycle.current())),
+	}, err
+}
+
+// Samples hardware data and sends it with the job state and app status as one
+// document every interval until ctx is done. Until the client has a tag
+// number, reports are keyed by serial. Self-metrics are added to a report
+// every metricsInterval.
+func runTelemetryReporter(ctx context.Context, interval time.Duration, metricsInterval time.Duration) {
+	backoff := retry.Policy{
+		Name:            "telemetry",
+		InitialInterval: interval,
+		MaxInterval:     max(interval, 2*time.Minute),
+	}.NewBackoff()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	// Collection errors repeat every interval on the same hardware, only log changes
+	lastCollectErr := ""
+	var metricsSent time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		liveData, err := collectLiveData(ctx)
+		if liveData == nil {
+			timer.Reset(interval)
+			continue
+		}
+		if msg := fmt.Sprint(err); err != nil && msg != lastCollectErr {
+			logging.Component("telemetry").Warn("incomplete hardware data", "error", err)
+			lastCollectErr = msg
+		} else if err == nil {
+			lastCollectErr = ""
+		}
+		if time.Since(metricsSent) >= metricsInterval {
+			liveData.Metrics = metrics.Snapshot()
+		}
+
+		if err := requests.PostLiveData(ctx, liveData); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			lifecycle.count(func(c *LifecycleCounters) { c.TelemetryFailures++ })
+			timer.Reset(backoff.Delay(err))
+			continue
+		}
+		backoff.Success()
+		lifecycle.count(func(c *LifecycleCounters) { c.TelemetryReports++ })
+		if liveData.Metrics != nil {
+			metricsSent = time.Now()
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Posts last_heard every interval until ctx is done. It runs apart from the
+// live data reports, so the server still hears from a client whose live data
+// cannot be collected or is rejected.
+func runLastHeardReporter(ctx context.Context, interval time.Duration) {
+	backoff := retry.Policy{
+		Name:            "last_heard",
+		InitialInterval: interval,
+		MaxInterval:     max(interval, 2*time.Minute),
+	}.NewBackoff()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		serial := systemSerial.Load()
+		if serial == nil {
+			timer.Reset(interval)
+			continue
+		}
+		tag := tagnumber.Load()
+		if err := requests.PostLastHeard(ctx, tag, *serial, time.Now()); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logging.Component("telemetry").Warn("failed to report last heard", logging.Tagnumber(tag), "error", err)
+			timer.Reset(backoff.Delay(err))
+			continue
+		}
+		backoff.Success()
+		timer.Reset(interval)
+	}
+}
@@ -24,6 +24,12 @@ type ClientConfig struct {
 	UIT_WEB_HTTPS_PORT   string `json:"UIT_WEB_HTTPS_PORT"`
 	UIT_WEBMASTER_NAME   string `json:"UIT_WEBMASTER_NAME"`
 	UIT_WEBMASTER_EMAIL  string `json:"UIT_WEBMASTER_EMAIL"`
+
+	// Live screenshot options, all optional
+	UIT_CLIENT_SCREENSHOT_FORMAT       string `json:"UIT_CLIENT_SCREENSHOT_FORMAT,omitempty"`       // png (default) or jpeg
+	UIT_CLIENT_SCREENSHOT_JPEG_QUALITY string `json:"UIT_CLIENT_SCREENSHOT_JPEG_QUALITY,omitempty"` // 1-100, default 75
+	UIT_CLIENT_SCREENSHOT_MAX_WIDTH    string `json:"UIT_CLIENT_SCREENSHOT_MAX_WIDTH,omitempty"`    // pixels, empty or 0 for full size
+	UIT_CLIENT_SCREENSHOT_KEEPALIVE    string `json:"UIT_CLIENT_SCREENSHOT_KEEPALIVE,omitempty"`    // duration, unchanged frames are resent this often
 }
 
 type HTTPRequest struct {
@@ -61,6 +67,26 @@ type BatteryData struct {
 	Percent      *float64 `json:"battery_charge_pcnt"`
 }
 
+type DiskTempData struct {
+	Tagnumber    *int64   `json:"tagnumber,omitempty"`
+	SystemSerial *string  `json:"system_serial,omitempty"`
+	Temp         *float64 `json:"disk_temp,omitempty"`
+	MaxTemp      *float64 `json:"disk_max_temp,omitempty"`
+}
+
+// Text of a virtual console, Text is plain or has ANSI color escapes
+type LiveConsoleData struct {
+	Tagnumber    *int64    `json:"tagnumber,omitempty"`
+	SystemSerial *string   `json:"system_serial,omitempty"`
+	Format       string    `json:"format"`
+	Lines        int       `json:"lines"`
+	Columns      int       `json:"columns"`
+	CursorX      int       `json:"cursor_x"`
+	CursorY      int       `json:"cursor_y"`
+	Text         string    `json:"text"`
+	CapturedAt   time.Time `json:"captured_at"`
+}
+
 type ClientUptime struct {
 	Tagnumber       *int64  `json:"tagnumber,omitempty"`
 	SystemSerial    *string `json:"system_serial,omitempty"`
@@ -10,8 +10,29 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"time"
+
+	"uit-clientd/logging"
 )
 
+// Log fields of a socket request, only the ones that are set
+func payloadAttrs(p *HTTPRequestPayload) []any {
+	if p == nil {
+		return nil
+	}
+	attrs := []any{logging.Key(p.Key)}
+	if p.Tagnumber != 0 {
+		attrs = append(attrs, logging.Tagnumber(p.Tagnumber))
+	}
+	if p.SystemSerial != "" {
+		attrs = append(attrs, logging.Serial(p.SystemSerial))
+	}
+	if p.TransactionUUID != nil && *p.TransactionUUID != "" {
+		attrs = append(attrs, logging.TransactionUUID(*p.TransactionUUID))
+	}
+	return attrs
+}
+
 func getUnixSocketListener() (net.Listener, bool, error) {
 	listener, err := getInheritedUnixSocketListener()
 	if err == nil {
@@ -22,14 +43,15 @@ func getUnixSocketListener() (net.Listener, bool, error) {
 	}
 
 	// Fallback in case systemd has no sockets available
-	listener, err = net.Listen("unix", unixSocketPath)
+	socketPath := daemonSettings.Load().SocketPath
+	listener, err = net.Listen("unix", socketPath)
 	if err != nil {
 		return nil, false, err
 	}
 
-	if err := os.Chmod(unixSocketPath, 0660); err != nil {
+	if err := os.Chmod(socketPath, 0660); err != nil {
 		_ = listener.Close()
-		_ = os.Remove(unixSocketPath)
+		_ = os.Remove(socketPath)
 		return nil, false, fmt.Errorf("failed to chmod unix socket: %w", err)
 	}
 
@@ -37,17 +59,16 @@ func getUnixSocketListener() (net.Listener, bool, error) {
 }
 
 func getInheritedUnixSocketListener() (net.Listener, error) {
-	listenPID := os.Getenv("LISTEN_PID")
 	listenFDs := os.Getenv("LISTEN_FDS")
-	if listenPID == "" || listenFDs == "" {
+	if listenFDs == "" {
 		return nil, os.ErrNotExist
 	}
 
-	pid, err := strconv.Atoi(listenPID)
+	forUs, err := systemdPIDMatches("LISTEN_PID")
 	if err != nil {
-		return nil, fmt.Errorf("invalid LISTEN_PID: %w", err)
+		return nil, err
 	}
-	if pid != os.Getpid() { // LISTEN_PID must match the current PID
+	if !forUs {
 		return nil, os.ErrNotExist
 	}
 
@@ -73,38 +94,58 @@ func getInheritedUnixSocketListener() (net.Listener, error) {
 	return listener, nil
 }
 
-func handleConnection(ctx context.Context, conn net.Conn) error {
+// Reads requests until ctx is done. A request already being handled runs
+// with reqCtx and still gets its response, conn is only closed once reqCtx is done.
+func handleConnection(ctx context.Context, reqCtx context.Context, conn net.Conn) error {
 	defer conn.Close()
+	socketConnections.Inc()
+	socketConnectionsActive.Inc()
+	defer socketConnectionsActive.Dec()
 
-	// Closes conn (and Scanner) when parent ctx is cancelled.
-	// Necessary in conjunction with ctx.Err() check at beginning of loop,
-	// otherwise scanner.Scan() listens indefinitely
+	// Stops reading when ctx is cancelled, without cutting off a request in
+	// progress. Necessary in conjunction with ctx.Err() check at beginning
+	// of loop, otherwise scanner.Scan() listens indefinitely
 	done := make(chan struct{})
 	go func() {
 		select {
 		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-done:
+			return
+		}
+		select {
+		case <-reqCtx.Done():
 			_ = conn.Close()
 		case <-done:
 		}
 	}()
 	defer close(done)
 
+	log := logging.Component("socket")
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
 		if ctx.Err() != nil {
+			log.Error("shutdown: DROPPED request received after shutdown started", "request", fmt.Sprintf("%.120s", scanner.Text()))
+			_, _ = fmt.Fprintf(conn, "ERROR: uit-clientd is shutting down\n")
 			break
 		}
-		response, err := handleInput(ctx, scanner.Text())
+		// A subscribe connection only streams events from here on
+		if isSubscribeRequest(scanner.Text()) {
+			return streamJobEvents(ctx, conn)
+		}
+		start := time.Now()
+		response, err := handleInput(reqCtx, scanner.Text())
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to handle input: %v\n", err)
+			log.Debug("request failed", logging.Latency(time.Since(start)), "error", err)
 			_, _ = fmt.Fprintf(conn, "ERROR: %v\n", err)
 			continue
 		}
+		log.Debug("request handled", logging.Latency(time.Since(start)), "response_bytes", len(response))
 		_, _ = fmt.Fprintf(conn, "%s\n", response)
 	}
 
 	if err := scanner.Err(); err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
-		return fmt.Errorf("unix socket read error: %v\n", err)
+		return fmt.Errorf("unix socket read error: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,237 @@
+//go:build linux && amd64
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"uit-clientd/logging"
+	"uit-clientd/requests"
+)
+
+type UsageSample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Fixed size ring buffer of samples, oldest first when read
+type usageRing struct {
+	mu      sync.Mutex
+	samples []UsageSample
+	next    int
+	full    bool
+}
+
+func newUsageRing(size int) *usageRing {
+	return &usageRing{samples: make([]UsageSample, size)}
+}
+
+func (r *usageRing) add(s UsageSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Returns a copy of all samples, oldest first
+func (r *usageRing) snapshot() []UsageSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]UsageSample(nil), r.samples[:r.next]...)
+	}
+	out := make([]UsageSample, 0, len(r.samples))
+	out = append(out, r.samples[r.next:]...)
+	return append(out, r.samples[:r.next]...)
+}
+
+type usageMetric struct {
+	unit string
+	ring *usageRing
+}
+
+var (
+	usageHistory        map[string]*usageMetric
+	usageSampleInterval time.Duration
+)
+
+// Sizes the usage history to cover duration at the sample interval. Called
+// once at startup, before the sampler or the socket use it.
+func initUsageHistory(interval time.Duration, duration time.Duration) {
+	size := int(duration/interval) + 1
+	usageSampleInterval = interval
+	usageHistory = map[string]*usageMetric{
+		"cpu":     {unit: "percent", ring: newUsageRing(size)},
+		"network": {unit: "kbit/s", ring: newUsageRing(size)},
+	}
+}
+
+// Samples CPU and network usage every interval until ctx is done. Runs from
+// startup, it does not need the server.
+func runUsageSampler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Sources that keep failing, only logged when they start or stop failing
+	failing := map[string]bool{}
+	logFailure := func(metric string, err error) {
+		if err != nil && !failing[metric] && ctx.Err() == nil {
+			logging.Component("usage_history").Warn("cannot sample", "metric", metric, "error", err)
+		}
+		failing[metric] = err != nil
+	}
+
+	for {
+		var wg sync.WaitGroup
+		var cpuErr, netErr error
+		wg.Go(func() {
+			var usage float64
+			usage, cpuErr = requests.GetCPUUsage(ctx)
+			if cpuErr == nil {
+				usageHistory["cpu"].ring.add(UsageSample{Time: time.Now(), Value: usage})
+			}
+		})
+		wg.Go(func() {
+			var kbps float64
+			_, kbps, netErr = requests.GetNetworkData(ctx)
+			if netErr == nil {
+				usageHistory["network"].ring.add(UsageSample{Time: time.Now(), Value: kbps})
+			}
+		})
+		wg.Wait()
+		logFailure("cpu", cpuErr)
+		logFailure("network", netErr)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type UsageStats struct {
+	Count int       `json:"count"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	From  time.Time `json:"from,omitzero"`
+	To    time.Time `json:"to,omitzero"`
+}
+
+// UsageHistoryResponse is returned as JSON for the usage_history socket key.
+// Incomplete is set when since is older than the history, because the
+// samples were dropped or uit-clientd was not running yet.
+type UsageHistoryResponse struct {
+	Metric     string        `json:"metric"`
+	Unit       string        `json:"unit"`
+	Capacity   int           `json:"capacity"`
+	Incomplete bool          `json:"incomplete,omitempty"`
+	Samples    []UsageSample `json:"samples"`
+	Stats      UsageStats    `json:"stats"`
+}
+
+func usageStats(samples []UsageSample) UsageStats {
+	var st UsageStats
+	if len(samples) == 0 {
+		return st
+	}
+	st.Count = len(samples)
+	st.Min, st.Max = samples[0].Value, samples[0].Value
+	st.From, st.To = samples[0].Time, samples[len(samples)-1].Time
+	var sum float64
+	for _, s := range samples {
+		st.Min = min(st.Min, s.Value)
+		st.Max = max(st.Max, s.Value)
+		sum += s.Value
+	}
+	st.Avg = sum / float64(len(samples))
+	return st
+}
+
+// Answers a usage_history query. The value is URL query encoded:
+//
+//	metric=cpu|network (required)
+//	since=<RFC3339 time>  only samples at or after this time, flagged incomplete
+//	                      if the history does not reach back that far
+//	window=<duration>     only samples from the last duration
+//	last=<n>              at most the n newest samples (default 1 without since or window)
+//	stats_only=true       leave out the samples
+//
+// Stats are computed over the selected samples.
+func queryUsageHistory(value string) (string, error) {
+	q, err := url.ParseQuery(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("invalid usage_history query '%s': %w", value, err)
+	}
+	name := q.Get("metric")
+	metric, ok := usageHistory[name]
+	if !ok {
+		return "", fmt.Errorf("unknown usage_history metric '%s', expected cpu or network", name)
+	}
+
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return "", fmt.Errorf("invalid since '%s': %w", v, err)
+		}
+	}
+	if v := q.Get("window"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return "", fmt.Errorf("invalid window '%s'", v)
+		}
+		if from := time.Now().Add(-window); from.After(since) {
+			since = from
+		}
+	}
+	last := 0
+	if v := q.Get("last"); v != "" {
+		if last, err = strconv.Atoi(v); err != nil || last <= 0 {
+			return "", fmt.Errorf("invalid last '%s'", v)
+		}
+	} else if since.IsZero() {
+		last = 1
+	}
+
+	samples := metric.ring.snapshot()
+	// The first sample after since can be up to one interval later
+	incomplete := !since.IsZero() && (len(samples) == 0 || samples[0].Time.After(since.Add(usageSampleInterval)))
+	if !since.IsZero() {
+		i := 0
+		for i < len(samples) && samples[i].Time.Before(since) {
+			i++
+		}
+		samples = samples[i:]
+	}
+	if last > 0 && len(samples) > last {
+		samples = samples[len(samples)-last:]
+	}
+
+	resp := UsageHistoryResponse{
+		Metric:     name,
+		Unit:       metric.unit,
+		Capacity:   len(metric.ring.samples),
+		Incomplete: incomplete,
+		Samples:    samples,
+		Stats:      usageStats(samples),
+	}
+	if q.Get("stats_only") == "true" {
+		resp.Samples = nil
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal usage history: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,177 @@
+//go:build linux && amd64
+
+package vconsole
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const DefaultDevice = "/dev/vcsa1"
+
+// Cell is one character position on the console
+type Cell struct {
+	Rune rune
+	// VGA attribute: foreground in bits 0-3 (bit 3 is bright), background in
+	// bits 4-6, blink in bit 7
+	Attr uint8
+}
+
+// Screen is the contents of a virtual console
+type Screen struct {
+	Lines   int
+	Columns int
+	CursorX int // 0-based
+	CursorY int
+	Cells   []Cell // Lines*Columns, row by row
+}
+
+// Read captures a virtual console from its /dev/vcsaN device. Characters are
+// taken from the matching /dev/vcsuN when the kernel has it, so they are
+// Unicode instead of the glyph numbers of the console font.
+func Read(device string) (*Screen, error) {
+	vcsa, err := os.ReadFile(device)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read console '%s': %w", device, err)
+	}
+	var vcsu []byte
+	if unicodeDevice, ok := unicodeDeviceFor(device); ok {
+		vcsu, err = os.ReadFile(unicodeDevice)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("cannot read console '%s': %w", unicodeDevice, err)
+		}
+	}
+	return Parse(vcsa, vcsu)
+}
+
+// /dev/vcsa1 -> /dev/vcsu1
+func unicodeDeviceFor(device string) (string, bool) {
+	i := strings.LastIndex(device, "vcsa")
+	if i < 0 {
+		return "", false
+	}
+	return device[:i] + "vcsu" + device[i+len("vcsa"):], true
+}
+
+// Parse decodes the contents of /dev/vcsaN: a header of lines, columns and
+// cursor position, then a character and attribute byte per cell. vcsu is the
+// contents of /dev/vcsuN (one little-endian UTF-32 value per cell) or nil to
+// map the characters from code page 437.
+func Parse(vcsa []byte, vcsu []byte) (*Screen, error) {
+	if len(vcsa) < 4 {
+		return nil, fmt.Errorf("console header too short: %d bytes", len(vcsa))
+	}
+	s := &Screen{
+		Lines:   int(vcsa[0]),
+		Columns: int(vcsa[1]),
+		CursorX: int(vcsa[2]),
+		CursorY: int(vcsa[3]),
+	}
+	if s.Lines == 0 || s.Columns == 0 {
+		return nil, fmt.Errorf("invalid console size %dx%d", s.Columns, s.Lines)
+	}
+	cells := s.Lines * s.Columns
+	if len(vcsa) < 4+cells*2 {
+		return nil, fmt.Errorf("console too short: %d bytes for %dx%d", len(vcsa), s.Columns, s.Lines)
+	}
+	// Resized between the two reads, fall back to the code page
+	if len(vcsu) != cells*4 {
+		vcsu = nil
+	}
+
+	s.Cells = make([]Cell, cells)
+	for i := range cells {
+		c := Cell{Attr: vcsa[4+i*2+1]}
+		if vcsu != nil {
+			c.Rune = rune(binary.LittleEndian.Uint32(vcsu[i*4:]))
+		} else {
+			c.Rune = cp437[vcsa[4+i*2]]
+		}
+		if c.Rune == 0 {
+			c.Rune = ' '
+		}
+		s.Cells[i] = c
+	}
+	return s, nil
+}
+
+func (s *Screen) line(y int) []Cell {
+	return s.Cells[y*s.Columns : (y+1)*s.Columns]
+}
+
+// Number of lines up to the last one with text on it
+func (s *Screen) usedLines() int {
+	for y := s.Lines - 1; y >= 0; y-- {
+		for _, c := range s.line(y) {
+			if c.Rune != ' ' {
+				return y + 1
+			}
+		}
+	}
+	return 0
+}
+
+// Text renders the screen as plain text, without trailing spaces or blank
+// lines at the bottom
+func (s *Screen) Text() string {
+	var b strings.Builder
+	for y := range s.usedLines() {
+		var line strings.Builder
+		for _, c := range s.line(y) {
+			line.WriteRune(c.Rune)
+		}
+		b.WriteString(strings.TrimRight(line.String(), " "))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// VGA color order to ANSI color order
+var vgaToANSI = [8]int{0, 4, 2, 6, 1, 5, 3, 7}
+
+func sgr(attr uint8) string {
+	fg := int(attr & 0x0f)
+	bg := int(attr>>4) & 0x07
+	codes := []string{"0"}
+	if fg >= 8 {
+		codes = append(codes, strconv.Itoa(90+vgaToANSI[fg-8]))
+	} else {
+		codes = append(codes, strconv.Itoa(30+vgaToANSI[fg]))
+	}
+	codes = append(codes, strconv.Itoa(40+vgaToANSI[bg]))
+	if attr&0x80 != 0 {
+		codes = append(codes, "5")
+	}
+	return "\x1b[" + strings.Join(codes, ";") + "m"
+}
+
+// ANSI renders the screen with SGR color escapes. Colors are reset at the end
+// of every line, so lines can be shown on their own.
+func (s *Screen) ANSI() string {
+	var b strings.Builder
+	for y := range s.usedLines() {
+		cells := s.line(y)
+		// Trailing spaces only matter if they have a background color
+		end := len(cells)
+		for end > 0 && cells[end-1].Rune == ' ' && cells[end-1].Attr&0x70 == 0 {
+			end--
+		}
+		last := -1
+		for _, c := range cells[:end] {
+			if int(c.Attr) != last {
+				b.WriteString(sgr(c.Attr))
+				last = int(c.Attr)
+			}
+			b.WriteRune(c.Rune)
+		}
+		if last >= 0 {
+			b.WriteString("\x1b[0m")
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
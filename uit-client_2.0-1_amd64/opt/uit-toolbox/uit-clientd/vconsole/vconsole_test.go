@@ -0,0 +1,173 @@
+//go:build linux && amd64
+
+package vconsole
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Builds /dev/vcsaN contents, text is one byte per cell row by row and every
+// cell gets attr
+func vcsaBytes(lines int, columns int, cursorX int, cursorY int, text string, attr uint8) []byte {
+	b := []byte{byte(lines), byte(columns), byte(cursorX), byte(cursorY)}
+	for i := range lines * columns {
+		c := byte(' ')
+		if i < len(text) {
+			c = text[i]
+		}
+		b = append(b, c, attr)
+	}
+	return b
+}
+
+func vcsuBytes(runes []rune) []byte {
+	var b []byte
+	for _, r := range runes {
+		b = binary.LittleEndian.AppendUint32(b, uint32(r))
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	// "ok" and the CP437 glyphs for é and a full block, on a 4x2 console
+	vcsa := vcsaBytes(2, 4, 1, 1, "ok\x82\xdb", 0x07)
+	tests := []struct {
+		name string
+		vcsu []byte
+		want []rune
+	}{
+		{"code page", nil, []rune("oké█    ")},
+		{"unicode", vcsuBytes([]rune("ok€✓ \x00 λ")), []rune("ok€✓   λ")},
+		{"unicode from another console size", vcsuBytes([]rune("xyz")), []rune("oké█    ")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(vcsa, tt.vcsu)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if s.Lines != 2 || s.Columns != 4 || s.CursorX != 1 || s.CursorY != 1 {
+				t.Errorf("screen %dx%d cursor %d,%d, want 4x2 cursor 1,1", s.Columns, s.Lines, s.CursorX, s.CursorY)
+			}
+			if len(s.Cells) != len(tt.want) {
+				t.Fatalf("%d cells, want %d", len(s.Cells), len(tt.want))
+			}
+			for i, c := range s.Cells {
+				if c.Rune != tt.want[i] || c.Attr != 0x07 {
+					t.Errorf("cell %d = %q attr %#x, want %q attr 0x07", i, c.Rune, c.Attr, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		vcsa []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{25, 80, 0}},
+		{"no lines", []byte{0, 80, 0, 0}},
+		{"no columns", []byte{25, 0, 0, 0}},
+		{"short cells", vcsaBytes(2, 4, 0, 0, "", 0x07)[:10]},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.vcsa, nil); err == nil {
+			t.Errorf("%s: Parse succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	s, err := Parse(vcsaBytes(4, 5, 0, 0, "ab   "+"     "+" c  d"+"     ", 0x07), nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got, want := s.Text(), "ab\n\n c  d\n"; got != want {
+		t.Errorf("Text = %q, want %q", got, want)
+	}
+
+	blank, err := Parse(vcsaBytes(2, 2, 0, 0, "", 0x07), nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := blank.Text(); got != "" {
+		t.Errorf("blank Text = %q, want empty", got)
+	}
+}
+
+func TestANSI(t *testing.T) {
+	// Bright white on blue, then light gray on black with a trailing space
+	// that has no background and is dropped
+	vcsa := []byte{1, 4, 0, 0, 'h', 0x1f, 'i', 0x1f, '!', 0x07, ' ', 0x07}
+	s, err := Parse(vcsa, nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := "\x1b[0;97;44mhi\x1b[0;37;40m!\x1b[0m\n"
+	if got := s.ANSI(); got != want {
+		t.Errorf("ANSI = %q, want %q", got, want)
+	}
+
+	// Blinking red on a cyan background, trailing spaces keep the background
+	s, err = Parse([]byte{1, 2, 0, 0, 'x', 0xb4, ' ', 0x30}, nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want = "\x1b[0;31;46;5mx\x1b[0;30;46m \x1b[0m\n"
+	if got := s.ANSI(); got != want {
+		t.Errorf("ANSI = %q, want %q", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "vcsa1")
+	if err := os.WriteFile(device, vcsaBytes(1, 2, 0, 0, "\x82\x82", 0x07), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Read(device)
+	if err != nil {
+		t.Fatalf("Read without vcsu: %v", err)
+	}
+	if got := s.Text(); got != "éé\n" {
+		t.Errorf("Read without vcsu: Text = %q, want %q", got, "éé\n")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "vcsu1"), vcsuBytes([]rune("日本")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Read(device)
+	if err != nil {
+		t.Fatalf("Read with vcsu: %v", err)
+	}
+	if got := s.Text(); got != "日本\n" {
+		t.Errorf("Read with vcsu: Text = %q, want %q", got, "日本\n")
+	}
+
+	if _, err := Read(filepath.Join(dir, "vcsa2")); err == nil {
+		t.Error("Read of a missing console succeeded")
+	}
+}
+
+func TestUnicodeDeviceFor(t *testing.T) {
+	tests := []struct {
+		device string
+		want   string
+		ok     bool
+	}{
+		{"/dev/vcsa1", "/dev/vcsu1", true},
+		{"/dev/vcsa", "/dev/vcsu", true},
+		{"/dev/vcs1", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := unicodeDeviceFor(tt.device); got != tt.want || ok != tt.ok {
+			t.Errorf("unicodeDeviceFor(%q) = %q, %v, want %q, %v", tt.device, got, ok, tt.want, tt.ok)
+		}
+	}
+}